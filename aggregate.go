@@ -0,0 +1,132 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"slices"
+)
+
+// A VRP is redundant when another VRP for the same ASN covers its prefix
+// with a max length at least as long, and expires no sooner. Every route it
+// matches is matched by the covering VRP, and every route it covers is
+// covered by it too, so removing it doesn't change the validation result of
+// any route until after it would have expired anyway.
+
+// packedVRP is implemented by vrp4 and vrp6 so both can share aggregation.
+type packedVRP[T any] interface {
+	vrp4 | vrp6
+	contains(T) bool
+	maxLength() uint8
+	origin() uint32
+	expiry() uint32
+	merged(T) T
+}
+
+// aggregate returns a normalized set with all redundant VRPs removed, along
+// with how many were removed. s is left untouched.
+func (s vrpSet) aggregate() (vrpSet, int) {
+	agg := vrpSet{
+		v4: aggregateFamily(s.v4, compareAggregate4),
+		v6: aggregateFamily(s.v6, compareAggregate6),
+	}
+	agg.normalize()
+	return agg, s.len() - agg.len()
+}
+
+// aggregateFamily works one ASN at a time, in address order. Each VRP is
+// checked against the chain of kept VRPs covering it. A VRP that's removed is
+// never needed on the chain, as whatever it covers, the VRP that made it
+// redundant covers too, for at least as long.
+func aggregateFamily[T packedVRP[T]](vrps []T, compare func(a, b T) int) []T {
+	sorted := slices.Clone(vrps)
+	slices.SortFunc(sorted, compare)
+
+	kept := sorted[:0]
+	var chain []T
+	for _, v := range sorted {
+		for len(chain) > 0 {
+			top := chain[len(chain)-1]
+			if top.origin() == v.origin() && top.contains(v) {
+				break
+			}
+			chain = chain[:len(chain)-1]
+		}
+		if slices.ContainsFunc(chain, func(c T) bool {
+			return c.maxLength() >= v.maxLength() && compareExpiry(c.expiry(), v.expiry()) >= 0
+		}) {
+			continue
+		}
+		kept = append(kept, v)
+		chain = append(chain, v)
+	}
+	return slices.Clip(kept)
+}
+
+// compareAggregate4 orders by ASN, then address and prefix length, so that
+// covering prefixes always come first. The longest max length comes first
+// for the same prefix.
+func compareAggregate4(a, b vrp4) int {
+	if c := cmp.Compare(a.asn, b.asn); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(binary.BigEndian.Uint32(a.addr[:]), binary.BigEndian.Uint32(b.addr[:])); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.bits, b.bits); c != 0 {
+		return c
+	}
+	return cmp.Compare(b.max, a.max)
+}
+
+// compareAggregate6 is the same as compareAggregate4 for IPv6.
+func compareAggregate6(a, b vrp6) int {
+	if c := cmp.Compare(a.asn, b.asn); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(binary.BigEndian.Uint64(a.addr[:8]), binary.BigEndian.Uint64(b.addr[:8])); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(binary.BigEndian.Uint64(a.addr[8:]), binary.BigEndian.Uint64(b.addr[8:])); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.bits, b.bits); c != 0 {
+		return c
+	}
+	return cmp.Compare(b.max, a.max)
+}
+
+// contains reports whether o is the same as or more specific than v.
+func (v vrp4) contains(o vrp4) bool {
+	if v.bits > o.bits {
+		return false
+	}
+	if v.bits == 0 {
+		return true
+	}
+	x := binary.BigEndian.Uint32(v.addr[:]) ^ binary.BigEndian.Uint32(o.addr[:])
+	return x>>(32-v.bits) == 0
+}
+
+// contains reports whether o is the same as or more specific than v.
+func (v vrp6) contains(o vrp6) bool {
+	if v.bits > o.bits {
+		return false
+	}
+	hi := binary.BigEndian.Uint64(v.addr[:8]) ^ binary.BigEndian.Uint64(o.addr[:8])
+	lo := binary.BigEndian.Uint64(v.addr[8:]) ^ binary.BigEndian.Uint64(o.addr[8:])
+	switch {
+	case v.bits == 0:
+		return true
+	case v.bits <= 64:
+		return hi>>(64-v.bits) == 0
+	default:
+		return hi == 0 && lo>>(128-v.bits) == 0
+	}
+}
+
+func (v vrp4) maxLength() uint8 { return v.max }
+func (v vrp6) maxLength() uint8 { return v.max }
+func (v vrp4) origin() uint32   { return v.asn }
+func (v vrp6) origin() uint32   { return v.asn }
+func (v vrp4) expiry() uint32   { return v.expires }
+func (v vrp6) expiry() uint32   { return v.expires }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []roa
+		want  []roa
+	}{
+		{
+			desc: "more specific within max length",
+			input: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 1},
+				{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 1},
+			},
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 1},
+			},
+		},
+		{
+			desc: "more specific with a longer max length is kept",
+			input: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 16, ASN: 1},
+				{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 1},
+			},
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 16, ASN: 1},
+				{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 1},
+			},
+		},
+		{
+			desc: "different ASN is kept",
+			input: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 1},
+				{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 2},
+			},
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 1},
+				{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 2},
+			},
+		},
+		{
+			desc: "same prefix with a shorter max length",
+			input: []roa{
+				{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 32, ASN: 1},
+				{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 1},
+			},
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 1},
+			},
+		},
+		{
+			desc: "covering VRP expiring sooner",
+			input: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 1, Expires: 100},
+				{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 1, Expires: 200},
+				{Prefix: netip.MustParsePrefix("10.0.2.0/24"), MaxMask: 24, ASN: 1},
+				{Prefix: netip.MustParsePrefix("10.0.3.0/24"), MaxMask: 24, ASN: 1, Expires: 50},
+			},
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 1, Expires: 100},
+				{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 1, Expires: 200},
+				{Prefix: netip.MustParsePrefix("10.0.2.0/24"), MaxMask: 24, ASN: 1},
+			},
+		},
+		{
+			desc: "covered by a grandparent that outlives the parent",
+			input: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/8"), MaxMask: 24, ASN: 1},
+				{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 1, Expires: 100},
+				{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 1, Expires: 200},
+			},
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("10.0.0.0/8"), MaxMask: 24, ASN: 1},
+			},
+		},
+		{
+			desc: "covered by a grandparent after a sibling",
+			input: []roa{
+				{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 64, ASN: 1},
+				{Prefix: netip.MustParsePrefix("2001:db8::/40"), MaxMask: 40, ASN: 1},
+				{Prefix: netip.MustParsePrefix("2001:db8:100::/40"), MaxMask: 64, ASN: 1},
+				{Prefix: netip.MustParsePrefix("2001:db9::/48"), MaxMask: 48, ASN: 1},
+			},
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 64, ASN: 1},
+				{Prefix: netip.MustParsePrefix("2001:db9::/48"), MaxMask: 48, ASN: 1},
+			},
+		},
+	}
+	for _, v := range tests {
+		got, removed := newVRPSet(v.input).aggregate()
+		if !slices.Equal(got.roas(), v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got.roas(), v.want)
+		}
+		if removed != len(v.input)-len(v.want) {
+			t.Errorf("Error on %s. Got %d removed, Want %d", v.desc, removed, len(v.input)-len(v.want))
+		}
+	}
+}
+
+// validate returns the RFC 6811 state of a route: 0 not found, 1 valid and
+// 2 invalid.
+func validate(vrps []roa, route netip.Prefix, asn uint32) int {
+	state := 0
+	for _, v := range vrps {
+		if v.Prefix.Bits() > route.Bits() || !v.Prefix.Contains(route.Addr()) {
+			continue
+		}
+		if v.ASN == asn && route.Bits() <= int(v.MaxMask) && asn != 0 {
+			return 1
+		}
+		state = 2
+	}
+	return state
+}
+
+// TestAggregateLossless checks that validation is unchanged for every route
+// within a small address range.
+func TestAggregateLossless(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	var input []roa
+	for range 300 {
+		bits := 16 + r.IntN(9)
+		addr := netip.AddrFrom4([4]byte{10, 0, byte(r.IntN(4)), 0})
+		input = append(input, roa{
+			Prefix:  netip.PrefixFrom(addr, bits).Masked(),
+			MaxMask: uint8(bits + r.IntN(25-bits)),
+			ASN:     uint32(r.IntN(3)),
+		})
+	}
+	set := newVRPSet(input)
+	agg, removed := set.aggregate()
+	if removed == 0 {
+		t.Fatalf("Nothing was aggregated")
+	}
+	before, after := set.roas(), agg.roas()
+
+	for bits := 14; bits <= 26; bits++ {
+		for i := range 1 << 10 {
+			addr := netip.AddrFrom4([4]byte{10, 0, byte(i >> 6), byte(i << 2)})
+			route := netip.PrefixFrom(addr, bits).Masked()
+			for asn := range uint32(3) {
+				if b, a := validate(before, route, asn), validate(after, route, asn); b != a {
+					t.Fatalf("%v from AS%d was %d, now %d", route, asn, b, a)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// pduCache holds prefix PDUs already encoded for a snapshot. Each set is
+// only encoded once per protocol version, however many clients ask for it.
+// The blobs are never modified once created, so clients can write them out
+// without holding any lock. They're released along with the snapshot once
+// no client is using it.
+type pduCache struct {
+	mutex sync.Mutex
+	full  map[uint8][]byte
+	diff  map[uint8][]byte
+}
+
+func newPDUCache() *pduCache {
+	return &pduCache{
+		full: make(map[uint8][]byte),
+		diff: make(map[uint8][]byte),
+	}
+}
+
+// fullSet returns announcements for every VRP in the snapshot.
+func (p *pduCache) fullSet(version uint8, vrps vrpSet) []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if b, ok := p.full[version]; ok {
+		return b
+	}
+	b := make([]byte, 0, len(vrps.v4)*20+len(vrps.v6)*32)
+	for _, v := range vrps.v4 {
+		pdu := v.pdu(announce)
+		b = pdu.append(b, version)
+	}
+	for _, v := range vrps.v6 {
+		pdu := v.pdu(announce)
+		b = pdu.append(b, version)
+	}
+	p.full[version] = b
+	log.Printf("Encoded %d VRPs for version %d in %d bytes\n", vrps.len(), version, len(b))
+
+	return b
+}
+
+// diffSet returns the announcements and withdrawals to get to the snapshot
+// from the one before.
+func (p *pduCache) diffSet(version uint8, diff *serialDiff) []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if b, ok := p.diff[version]; ok {
+		return b
+	}
+	b := make([]byte, 0, encodedSize(diff.addRoa)+encodedSize(diff.delRoa))
+	for _, roa := range diff.addRoa {
+		b = appendPrefixPDU(b, &roa, announce, version)
+	}
+	for _, roa := range diff.delRoa {
+		b = appendPrefixPDU(b, &roa, withdraw, version)
+	}
+	p.diff[version] = b
+
+	return b
+}
+
+// encodedSize is how many bytes roas will take once encoded.
+func encodedSize(roas []roa) int {
+	var size int
+	for _, roa := range roas {
+		if roa.Prefix.Addr().Is4() {
+			size += 20
+		} else {
+			size += 32
+		}
+	}
+	return size
+}
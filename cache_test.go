@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPDUCache(t *testing.T) {
+	roas := []roa{
+		{Prefix: netip.MustParsePrefix("192.168.1.0/24"), MaxMask: 24, ASN: 123},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 123},
+	}
+	p := newPDUCache()
+	vrps := newVRPSet(roas)
+
+	v1 := p.fullSet(version1, vrps)
+	if len(v1) != 20+32 {
+		t.Fatalf("Got %d bytes, Want %d", len(v1), 20+32)
+	}
+	if v1[0] != version1 || v1[20] != version1 {
+		t.Errorf("PDUs encoded with wrong version: %v", v1)
+	}
+
+	// The same serial and version is only encoded once.
+	if again := p.fullSet(version1, vrpSet{}); &again[0] != &v1[0] {
+		t.Errorf("Full set for the same serial was encoded again")
+	}
+
+	// Each version is encoded separately.
+	v2 := p.fullSet(version2, vrps)
+	if v2[0] != version2 || v2[20] != version2 {
+		t.Errorf("PDUs encoded with wrong version: %v", v2)
+	}
+
+	// A new snapshot starts with nothing encoded.
+	one := newVRPSet(roas[:1])
+	p = newSnapshot(one, 2, 1, serialDiff{}).pdus
+	if got := p.fullSet(version1, one); len(got) != 20 {
+		t.Errorf("Got %d bytes for a new snapshot, Want %d", len(got), 20)
+	}
+
+	diff := &serialDiff{
+		oldSerial: 1,
+		newSerial: 2,
+		addRoa:    roas[:1],
+		delRoa:    roas[1:],
+		diff:      true,
+	}
+	got := p.diffSet(version1, diff)
+	if len(got) != 20+32 {
+		t.Fatalf("Got %d bytes of diff, Want %d", len(got), 20+32)
+	}
+	if got[8] != announce || got[20+8] != withdraw {
+		t.Errorf("Diff flags wrong, got %d and %d", got[8], got[20+8])
+	}
+}
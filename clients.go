@@ -1,57 +1,172 @@
 package main
 
 import (
+	"bufio"
 	"log"
-	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// clientQueueSize is the amount of responses that can be waiting to be
+	// written to a client.
+	clientQueueSize = 64
+
+	// clientQueueWait is how long a response will wait for room in a full
+	// queue before the client is disconnected.
+	clientQueueWait = 5 * time.Second
+
+	// clientWriteTimeout is how long a single chunk write to a client may take.
+	clientWriteTimeout = 30 * time.Second
+
+	// writeChunkSize is the most written to a client with a single deadline.
+	writeChunkSize = 64 * 1024
+
+	// writeBufferSize is the size of each client's reusable write buffer.
+	// PDUs are encoded in to this and flushed when full.
+	writeBufferSize = 256 * 1024
 )
 
 // Each client has their own stuff
 type client struct {
-	conn    net.Conn
-	addr    string
-	roas    *[]roa
-	serial  *uint32
-	mutex   *sync.RWMutex
-	diff    *serialDiff
-	version uint8
+	conn      net.Conn
+	addr      string
+	remote    string
+	listener  string
+	current   *atomic.Pointer[snapshot]
+	version   atomic.Uint32
+	tcpMutex  sync.Mutex
+	tcp       tcpStats
+	queue     chan response
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// response writes a complete set of PDUs. Responses are only ever run by the
+// client's writer, so they can't interleave with each other.
+type response func(w *bufio.Writer)
+
+// writer is the only goroutine which writes to the client connection. It
+// owns a buffer which is reused for every response.
+func (c *client) writer() {
+	w := bufio.NewWriterSize(chunkWriter{c.conn}, writeBufferSize)
+	for {
+		select {
+		case <-c.done:
+			return
+		case resp := <-c.queue:
+			resp(w)
+			if err := w.Flush(); err != nil {
+				log.Printf("unable to write to %s, disconnecting: %v\n", c.remote, err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// chunkWriter writes in chunks, each with it's own deadline. A slow client
+// is fine as long as it keeps making progress.
+type chunkWriter struct {
+	conn net.Conn
+}
+
+func (cw chunkWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := min(len(b), writeChunkSize)
+		if err := cw.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout)); err != nil {
+			return written, err
+		}
+		n, err := cw.conn.Write(b[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// send queues a response for the writer. If the queue is full it will wait
+// for a while, before giving up and disconnecting the client.
+func (c *client) send(resp response) {
+	select {
+	case c.queue <- resp:
+		return
+	case <-c.done:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(clientQueueWait)
+	defer timer.Stop()
+	select {
+	case c.queue <- resp:
+	case <-c.done:
+	case <-timer.C:
+		log.Printf("send queue to %s is full, disconnecting\n", c.remote)
+		c.close()
+	}
+}
+
+// trySend queues a response for the writer without waiting. If the queue is
+// full the client is disconnected.
+func (c *client) trySend(resp response) {
+	select {
+	case c.queue <- resp:
+	case <-c.done:
+	default:
+		log.Printf("send queue to %s is full, disconnecting\n", c.remote)
+		c.close()
+	}
+}
+
+// close will stop the writer and close the connection. Safe to call more
+// than once.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
 }
 
 // reset has no data besides the header
 func (c *client) sendReset() {
-	r := cacheResetPDU{}
-	r.serialize(c.conn)
+	version := c.protocolVersion()
+	c.send(func(w *bufio.Writer) {
+		r := cacheResetPDU{}
+		w.Write(r.append(w.AvailableBuffer(), version))
+	})
 }
 
 // updateClient will check to see if there are diffs to send.
 // If so it'll send them, otherwise it'll just send an end of data PDU updating
 // the serial.
-func (c *client) updateClient(session uint16, serial uint32, sendDiff bool) {
-	cpdu := cacheResponsePDU{
-		sessionID: session,
-	}
-	cpdu.serialize(c.conn)
-
+func (c *client) updateClient(session uint16, snap *snapshot, sendDiff bool) {
+	var diff []byte
+	version := c.protocolVersion()
 	// diff will only be sent if there is an actual update to send
-	if sendDiff && c.diff.diff {
-		c.mutex.RLock()
-		for _, roa := range c.diff.addRoa {
-			writePrefixPDU(&roa, c.conn, announce)
-		}
-		for _, roa := range c.diff.delRoa {
-			writePrefixPDU(&roa, c.conn, withdraw)
-		}
-		c.mutex.RUnlock()
-		log.Println("Finished sending all diffs")
+	if sendDiff && snap.diff.diff {
+		diff = snap.pdus.diffSet(version, &snap.diff)
 	}
+	epdu := getEndOfDataPDU(session, snap.serial)
 
-	epdu := getEndOfDataPDU(session, *c.serial)
-	epdu.serialize(c.conn)
+	c.send(func(w *bufio.Writer) {
+		cpdu := cacheResponsePDU{
+			sessionID: session,
+		}
+		w.Write(cpdu.append(w.AvailableBuffer(), version))
+		w.Write(diff)
+		w.Write(epdu.append(w.AvailableBuffer(), version))
+		log.Printf("Finished sending %d bytes of diffs to %s\n", len(diff), c.remote)
+	})
 }
 
-// writePrefixPDU will directly write the update or withdraw prefix PDU.
-func writePrefixPDU(r *roa, c net.Conn, flag uint8) {
+// appendPrefixPDU will encode the update or withdraw prefix PDU on to b.
+func appendPrefixPDU(b []byte, r *roa, flag, version uint8) []byte {
 	switch r.Prefix.Addr().Is4() {
 	case true:
 		ppdu := ipv4PrefixPDU{
@@ -61,8 +176,8 @@ func writePrefixPDU(r *roa, c net.Conn, flag uint8) {
 			prefix: r.Prefix.Addr().As4(),
 			asn:    r.ASN,
 		}
-		ppdu.serialize(c)
-	case false:
+		return ppdu.append(b, version)
+	default:
 		ppdu := ipv6PrefixPDU{
 			flags:  flag,
 			min:    uint8(r.Prefix.Bits()),
@@ -70,7 +185,7 @@ func writePrefixPDU(r *roa, c net.Conn, flag uint8) {
 			prefix: r.Prefix.Addr().As16(),
 			asn:    r.ASN,
 		}
-		ppdu.serialize(c)
+		return ppdu.append(b, version)
 	}
 }
 
@@ -84,55 +199,80 @@ func getEndOfDataPDU(session uint16, serial uint32) endOfDataPDU {
 	}
 }
 
-// Notify client that an update has taken place
+// Notify client that an update has taken place. This never waits for room
+// in the client's queue.
 func (c *client) notify(serial uint32, session uint16) {
-	npdu := serialNotifyPDU{
-		Session: session,
-		Serial:  serial,
+	// Nothing to notify until the client has told us it's version.
+	version := c.protocolVersion()
+	if version == 0 {
+		return
 	}
-	npdu.serialize(c.conn)
+	c.trySend(func(w *bufio.Writer) {
+		npdu := serialNotifyPDU{
+			Session: session,
+			Serial:  serial,
+		}
+		w.Write(npdu.append(w.AvailableBuffer(), version))
+	})
 }
 
 func (c *client) sendRoa() {
-	session := rand.Intn(100)
-	cpdu := cacheResponsePDU{
-		sessionID: uint16(session),
-	}
-	cpdu.serialize(c.conn)
-
-	c.mutex.RLock()
-	for _, roa := range *c.roas {
-		writePrefixPDU(&roa, c.conn, announce)
-	}
-	c.mutex.RUnlock()
-	log.Println("Finished sending all prefixes")
-	// TODO: Why am I sending default timers here? Should I save this per client?
-	epdu := endOfDataPDU{
-		session: uint16(session),
-		serial:  *c.serial,
-		refresh: DefaultRefreshInterval,
-		retry:   DefaultRetryInterval,
-		expire:  DefaultExpireInterval,
-	}
-	epdu.serialize(c.conn)
+	version := c.protocolVersion()
+
+	// The full set is shared with every other client on this snapshot.
+	snap := c.current.Load()
+	roas := snap.pdus.fullSet(version, snap.vrps)
+
+	c.send(func(w *bufio.Writer) {
+		cpdu := cacheResponsePDU{
+			sessionID: snap.session,
+		}
+		w.Write(cpdu.append(w.AvailableBuffer(), version))
+		w.Write(roas)
+		// TODO: Why am I sending default timers here? Should I save this per client?
+		epdu := endOfDataPDU{
+			session: snap.session,
+			serial:  snap.serial,
+			refresh: DefaultRefreshInterval,
+			retry:   DefaultRetryInterval,
+			expire:  DefaultExpireInterval,
+		}
+		w.Write(epdu.append(w.AvailableBuffer(), version))
+		log.Printf("Finished sending all prefixes to %s\n", c.remote)
+	})
 }
 
 // TODO: Test this somehow
 func (c *client) error(code int, report string) {
-	epdu := errorReportPDU{
-		code:   uint16(code),
-		report: report,
-	}
-	epdu.serialize(c.conn)
+	version := c.protocolVersion()
+	c.send(func(w *bufio.Writer) {
+		epdu := errorReportPDU{
+			code:   uint16(code),
+			report: report,
+		}
+		w.Write(epdu.append(w.AvailableBuffer(), version))
+	})
+}
+
+// protocolVersion is the version negotiated with the client, or zero if
+// nothing has been received yet.
+func (c *client) protocolVersion() uint8 {
+	return uint8(c.version.Load())
 }
 
 // Handle each client.
 func (s *CacheServer) handleClient(c *client) {
-	log.Printf("Serving %s\n", c.conn.RemoteAddr().String())
+	log.Printf("Serving %s on %s\n", c.conn.RemoteAddr().String(), c.listener)
 
 	// Remove client when exiting
 	defer s.remove(c)
-	defer c.conn.Close()
+	defer c.close()
+
+	// All writes to the client go through the writer.
+	go c.writer()
+
+	// Keep track of how healthy the TCP session is.
+	go c.sampleTCP()
 
 	// Initial connection negotiation
 	// What is the incoming PDU?
@@ -142,13 +282,13 @@ func (s *CacheServer) handleClient(c *client) {
 		return
 	}
 	// TODO: Is 2 a magic number?
-	header, err := decodePDUHeader(pdu[:2], c.version, true)
+	header, err := decodePDUHeader(pdu[:2], c.protocolVersion(), true)
 	if err != nil {
 		log.Printf("error received when decoding the header: %v", err)
 		return
 	}
 	// Set the version of the client
-	c.version = header.Version
+	c.version.Store(uint32(header.Version))
 
 	switch {
 	case header.Ptype == resetQuery:
@@ -157,28 +297,7 @@ func (s *CacheServer) handleClient(c *client) {
 
 	case header.Ptype == serialQuery:
 		log.Printf("received a serial Query PDU from %s\n", c.addr)
-		// TODO: Is 2 a magic number?
-		sq := getSerialQueryPDU(pdu[2:])
-		c.mutex.RLock()
-		serial := c.diff.newSerial
-		c.mutex.RUnlock()
-		// If the client sends in the current or previous serial, then we can handle it.
-		// If the serial is older or unknown, we need to send a reset.
-		if sq.Serial != serial && sq.Serial != serial-1 {
-			log.Printf("received a serial query PDU, with an unmanagable serial from %s\n", c.addr)
-			log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
-			c.sendReset()
-		}
-		if sq.Serial == serial {
-			log.Printf("received a serial number which currently matches my own from %s\n", c.addr)
-			log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
-			c.updateClient(sq.Session, serial, false)
-		}
-		if sq.Serial == serial-1 {
-			log.Printf("received a serial number one less, so sending diff to %s\n", c.addr)
-			log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
-			c.updateClient(sq.Session, serial, true)
-		}
+		c.serialQuery(pdu)
 	}
 	if header.Ptype != resetQuery && header.Ptype != serialQuery {
 		log.Printf("On startup, only resetQuery and serialQuery are allowed. Received %d\n", header.Ptype)
@@ -194,7 +313,7 @@ func (s *CacheServer) handleClient(c *client) {
 			log.Printf("error received when getting the pdu: %v", err)
 			return
 		}
-		header, err := decodePDUHeader(pdu[:2], c.version, false)
+		header, err := decodePDUHeader(pdu[:2], c.protocolVersion(), false)
 		if err != nil {
 			log.Printf("error received when decoding the header: %v", err)
 			return
@@ -207,29 +326,34 @@ func (s *CacheServer) handleClient(c *client) {
 
 		case header.Ptype == serialQuery:
 			log.Printf("received a serial Query PDU from %s\n", c.addr)
-			// TODO: Is 2 a magic number?
-			sq := getSerialQueryPDU(pdu[2:])
-			c.mutex.RLock()
-			serial := c.diff.newSerial
-			c.mutex.RUnlock()
-
-			// If the client sends in the current or previous serial, then we can handle it.
-			// If the serial is older or unknown, we need to send a reset.
-			if sq.Serial != serial && sq.Serial != serial-1 {
-				log.Printf("received a serial query PDU, with an unmanagable serial from %s\n", c.addr)
-				log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
-				c.sendReset()
-			}
-			if sq.Serial == serial {
-				log.Printf("received a serial number which currently matches my own from %s\n", c.addr)
-				log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
-				c.updateClient(sq.Session, serial, false)
-			}
-			if sq.Serial == serial-1 {
-				log.Printf("received a serial number one less, so sending diff to %s\n", c.addr)
-				log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
-				c.updateClient(sq.Session, serial, true)
-			}
+			c.serialQuery(pdu)
 		}
 	}
 }
+
+// serialQuery answers a serial query PDU from a single snapshot.
+func (c *client) serialQuery(pdu []byte) {
+	// TODO: Is 2 a magic number?
+	sq := getSerialQueryPDU(pdu[2:])
+	snap := c.current.Load()
+	serial := snap.serial
+
+	// If the client sends in the current or previous serial, then we can handle it.
+	// If the serial is older or unknown, we need to send a reset. A snapshot
+	// loaded from the state file has no diff, so only the current serial works.
+	if sq.Serial != serial && (sq.Serial != serial-1 || !snap.hasDiff()) {
+		log.Printf("received a serial query PDU, with an unmanagable serial from %s\n", c.addr)
+		log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
+		c.sendReset()
+	}
+	if sq.Serial == serial {
+		log.Printf("received a serial number which currently matches my own from %s\n", c.addr)
+		log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
+		c.updateClient(sq.Session, snap, false)
+	}
+	if sq.Serial == serial-1 && snap.hasDiff() {
+		log.Printf("received a serial number one less, so sending diff to %s\n", c.addr)
+		log.Printf("Serial received: %d. Current server serial: %d\n", sq.Serial, serial)
+		c.updateClient(sq.Session, snap, true)
+	}
+}
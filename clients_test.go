@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestGetPDU(t *testing.T) {
@@ -118,3 +122,37 @@ func TestDecodePDUHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestClientQueue(t *testing.T) {
+	server, router := net.Pipe()
+	defer router.Close()
+	c := &client{
+		conn:   server,
+		remote: "pipe",
+		queue:  make(chan response, 2),
+		done:   make(chan struct{}),
+	}
+	go c.writer()
+
+	// Each response must arrive whole and in order.
+	c.send(func(w *bufio.Writer) { w.Write([]byte{1, 2}); w.Write([]byte{3}) })
+	c.send(func(w *bufio.Writer) { w.Write([]byte{4}) })
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(router, got); err != nil {
+		t.Fatalf("Error reading from client: %v", err)
+	}
+	if !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Errorf("Got %v, Want %v", got, []byte{1, 2, 3, 4})
+	}
+
+	// Nothing is reading, so the writer blocks and the queue fills up.
+	c.trySend(func(w *bufio.Writer) { w.Write([]byte{5}) })
+	c.trySend(func(w *bufio.Writer) { w.Write([]byte{6}) })
+	c.trySend(func(w *bufio.Writer) { w.Write([]byte{7}) })
+	c.trySend(func(w *bufio.Writer) { w.Write([]byte{8}) })
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Errorf("Client with an overflowing queue was not disconnected")
+	}
+}
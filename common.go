@@ -2,47 +2,72 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"math"
 	"net/netip"
-	"slices"
+	"reflect"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type jsonroa struct {
-	Prefix string `json:"prefix"`
-	Mask   uint8  `json:"maxLength"`
-	ASN    any    `json:"asn"`
+	Prefix  string  `json:"prefix"`
+	Mask    uint8   `json:"maxLength"`
+	ASN     jsonASN `json:"asn"`
+	Expires int64   `json:"expires,omitempty"`
+	TA      string  `json:"ta,omitempty"`
 }
 
-type roas struct {
-	Roas []jsonroa `json:"roas"`
-}
+// Some URLs have the AS Number as a number while others as a string.
+type jsonASN uint32
 
-type rpkiResponse struct {
-	roas
+func (a *jsonASN) UnmarshalJSON(b []byte) error {
+	bad := &json.UnmarshalTypeError{Value: string(b), Type: reflect.TypeFor[jsonASN]()}
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return bad
+		}
+		n, err := parseASN(s)
+		if err != nil {
+			return bad
+		}
+		*a = jsonASN(n)
+		return nil
+	}
+	n, err := strconv.ParseUint(string(b), 10, 32)
+	if err != nil {
+		// Some feeds write numbers as floats, which is fine if they're whole.
+		f, ferr := strconv.ParseFloat(string(b), 64)
+		if ferr != nil || f != math.Trunc(f) || f < 0 || f > math.MaxUint32 {
+			return bad
+		}
+		n = uint64(f)
+	}
+	*a = jsonASN(n)
+	return nil
 }
 
 // makeDiff will return a list of ROAs that need to be deleted or updated
 // in order for a particular serial version to updated to the latest version.
-func makeDiff(new, old []roa, serial uint32) serialDiff {
+// Both sets are sorted, so this is a single merge over each address family.
+func makeDiff(new, old vrpSet, serial uint32) serialDiff {
 	var addROA, delROA []roa
 
-	// If ROA is in newMap but not oldMap, we need to add it
-	for _, roa := range new {
-		if !slices.Contains(old, roa) {
-			addROA = append(addROA, roa)
-		}
-	}
-
-	// If ROA is in oldMap but not newMap, we need to delete it.
-	for _, roa := range old {
-		if !slices.Contains(new, roa) {
-			delROA = append(delROA, roa)
-		}
-	}
+	// If ROA is in new but not old, we need to add it. If ROA is in old but
+	// not new, we need to delete it.
+	diffSorted(new.v4, old.v4, compareVRP4,
+		func(v vrp4) { addROA = append(addROA, v.roa()) },
+		func(v vrp4) { delROA = append(delROA, v.roa()) },
+	)
+	diffSorted(new.v6, old.v6, compareVRP6,
+		func(v vrp6) { addROA = append(addROA, v.roa()) },
+		func(v vrp6) { delROA = append(delROA, v.roa()) },
+	)
 
 	// There is only a diff is something is added or deleted.
 	diff := len(addROA) > 0 || len(delROA) > 0
@@ -56,135 +81,222 @@ func makeDiff(new, old []roa, serial uint32) serialDiff {
 	}
 }
 
-func readROAs(urls []string) ([]roa, error) {
-	var roas []roa
-	ch := make(chan []roa, len(urls))
+// readROAs downloads from all sources at once. Each source is packed as soon
+// as it's decoded, so only the packed sets are held while waiting on the rest.
+// The sets are then combined by policy. If no source has changed since the
+// last call, false is returned and the set can be ignored. It's an error for
+// every source to fail.
+func readROAs(sources []*source, policy mergePolicy) (vrpSet, bool, error) {
+	return readSources(sources, policy, true)
+}
+
+// readSources is readROAs, but unless fetchAll is set only the watched
+// sources are fetched again. The rest are merged with what they last returned.
+func readSources(sources []*source, policy mergePolicy, fetchAll bool) (vrpSet, bool, error) {
+	type result struct {
+		src     *source
+		vrps    vrpSet
+		changed bool
+		err     error
+		// fetched is false for a source reusing its last result.
+		fetched bool
+	}
+	// Results are kept in source order, which is the priority for failover.
+	all := make([]result, len(sources))
 	var wg sync.WaitGroup
-	for _, url := range urls {
+	for i, src := range sources {
 		wg.Add(1)
-		go fetchAndDecodeJSON(url, ch, &wg)
+		go func() {
+			defer wg.Done()
+			if !fetchAll && !src.watched() {
+				vrps, err := src.previous()
+				all[i] = result{src: src, vrps: vrps, err: err}
+				return
+			}
+			log.Printf("Downloading from %s\n", src.name)
+			vrps, changed, err := src.fetch()
+			if err != nil {
+				log.Printf("unable to retrieve ROAs from %s: %v\n", src.name, err)
+			} else if !changed {
+				log.Printf("%s has not changed\n", src.name)
+			}
+			all[i] = result{src: src, vrps: vrps, changed: changed || err != nil, err: err, fetched: true}
+		}()
 	}
 	wg.Wait()
-	close(ch)
-	for v := range ch {
-		roas = append(roas, v...)
-	}
-
-	validROAs := GetSetOfValidatedROAs(roas)
-
-	log.Printf("Created a unique set of %d ROAs\n", len(validROAs))
-
-	return validROAs, nil
-}
 
-// fetchAndDecodeJSON will fetch the latest set of ROAs and add to a local struct
-// https://console.rpki-client.org/vrps.json
-func fetchAndDecodeJSON(url string, ch chan []roa, wg *sync.WaitGroup) {
-	defer wg.Done()
-	log.Printf("Downloading from %s\n", url)
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("unable to retrieve ROAs from url: %v", err)
-		return
+	var results []result
+	var changed bool
+	for _, v := range all {
+		changed = changed || v.changed
+		if v.err == nil {
+			results = append(results, v)
+		}
 	}
-	defer resp.Body.Close()
-
-	f, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("unable to read body of response: %v", err)
-		return
+	if len(results) == 0 {
+		return vrpSet{}, false, fmt.Errorf("all %d sources failed", len(sources))
 	}
 
-	var r rpkiResponse
-	if err = json.Unmarshal(f, &r); err != nil {
-		log.Printf("unable to unmarshal: %v", err)
-		return
+	// With failover, only the chosen source matters. Switching counts as a
+	// change even if neither source has changed.
+	if fo := policy.failover; fo != nil {
+		before, _, _ := fo.status()
+		now := time.Now()
+		unhealthy := make([]error, len(all))
+		fetched := make([]bool, len(all))
+		for i, v := range all {
+			unhealthy[i] = fo.health(v.src, v.err, now)
+			fetched[i] = v.fetched
+		}
+		i, err := fo.choose(sources, unhealthy, fetched)
+		if err != nil {
+			return vrpSet{}, false, err
+		}
+		changed = all[i].changed || i != before
+		results = all[i : i+1]
+	}
+	if !changed {
+		return vrpSet{}, false, nil
 	}
 
-	// We know how many ROAs we have, so we can add that capacity directly
-	newROAs := make([]roa, 0, len(r.roas.Roas))
+	// Sources keep their sets for next time, so they must not be changed.
+	sets := make([]vrpSet, 0, len(results))
+	for _, v := range results {
+		sets = append(sets, v.vrps)
+	}
+	total := len(sources)
+	if policy.failover != nil {
+		total = 1
+	}
+	validROAs, err := policy.apply(sets, total)
+	if err != nil {
+		return vrpSet{}, false, err
+	}
 
-	for _, r := range r.roas.Roas {
-		prefix, err := netip.ParsePrefix(r.Prefix)
-		if err != nil {
-			log.Printf("%v", err)
-			ch <- newROAs
+	// Record where each source differs from what will be published.
+	for _, v := range all {
+		if v.err != nil {
+			continue
+		}
+		rejected, missing := agreement(v.vrps, validROAs)
+		v.src.setAgreement(rejected, missing)
+		if rejected > 0 || missing > 0 {
+			log.Printf("%s has %d ROAs not being published, and is missing %d that are\n", v.src.name, rejected, missing)
 		}
-		asn := decodeASN(r)
-		newROAs = append(newROAs, roa{
-			Prefix:  prefix,
-			MaxMask: r.Mask,
-			ASN:     asn,
-		})
 	}
 
-	ch <- newROAs
+	log.Printf("Created a unique set of %d ROAs from %d of %d sources by %s\n",
+		validROAs.len(), len(results), len(sources), policy.name)
 
-	log.Printf("Returning %d ROAs from %s\n", len(newROAs), url)
+	return validROAs, true, nil
 }
 
-// Some URLs have the AS Number as a number while others as a string.
-func decodeASN(data jsonroa) uint32 {
-	switch atype := data.ASN.(type) {
-	case string:
-		return asnToUint32(atype)
-	case float64:
-		return uint32(atype)
-	}
-	return 0
-}
+// decodeROAs walks the JSON one token at a time, adding each entry of the
+// roas array to set as it's read. The whole document is never held in memory.
+func decodeROAs(r io.Reader, set *vrpSet, meta *metadata) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		if key == "metadata" && meta != nil {
+			if err := decodeMetadata(dec, meta); err != nil {
+				return err
+			}
+			continue
+		}
+		if key != "roas" {
+			// Skip over anything else.
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
 
-// GetSetOfValidatedROAs returns a slice of ROAs with no duplicates.
-// It only appends if the ROA is valid
-func GetSetOfValidatedROAs(roas []roa) []roa {
-	u := make([]roa, 0, len(roas))
-	m := make(map[roa]bool)
-	for _, roa := range roas {
-		if _, ok := m[roa]; !ok {
-			m[roa] = true
-			if roa.isValid() {
-				u = append(u, roa)
+		if err := expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var jr jsonroa
+			if err := dec.Decode(&jr); err != nil {
+				// The entry has still been read when a value is the wrong
+				// type, so only that entry is skipped.
+				var typeErr *json.UnmarshalTypeError
+				if !errors.As(err, &typeErr) {
+					return err
+				}
+				log.Printf("skipping ROA: %v\n", err)
+				continue
+			}
+			prefix, err := netip.ParsePrefix(jr.Prefix)
+			if err != nil {
+				log.Printf("%v", err)
+				continue
 			}
+			set.add(roa{
+				Prefix:  prefix,
+				MaxMask: jr.Mask,
+				ASN:     uint32(jr.ASN),
+				Expires: jr.Expires,
+				TAs:     trustAnchors.bit(jr.TA),
+			})
 		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// expectDelim reads the next token, which must be delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %v but got %v", delim, tok)
 	}
-	return u
+	return nil
+}
+
+// GetSetOfValidatedROAs returns the set sorted with no duplicates. ROAs are
+// validated as they're added, so this only needs to work in place.
+func GetSetOfValidatedROAs(roas vrpSet) vrpSet {
+	roas.normalize()
+	return roas
 }
 
 // https://datatracker.ietf.org/doc/html/rfc6482#section-3.3
+// Copies are logged so that roa doesn't escape to the heap on every call.
 func (roa *roa) isValid() bool {
 	// MaxLength cannot be zero or negative
 	// MaxMask is a uint8 so cannot be negative
 	if roa.MaxMask == 0 {
-		log.Printf("maxmask <= 0: %#v\n", roa)
+		log.Printf("maxmask <= 0: %#v\n", *roa)
 		return false
 	}
 
 	// MaxLength cannot be smaller than prefix length
 	if roa.MaxMask < uint8(roa.Prefix.Bits()) {
-		log.Printf("maxmask < mask: %#v\n", roa)
+		log.Printf("maxmask < mask: %#v\n", *roa)
 		return false
 	}
 
 	// MaxLength cannot be larger than the max allowed for that address family
 	if roa.Prefix.Addr().Is4() && roa.MaxMask > 32 {
-		log.Printf("maxmask > max: %#v\n", roa)
+		log.Printf("maxmask > max: %#v\n", *roa)
 		return false
 	} else if roa.MaxMask > 128 {
-		log.Printf("maxmask > max: %#v\n", roa)
+		log.Printf("maxmask > max: %#v\n", *roa)
 		return false
 	}
 
 	return true
 }
-
-// Some json VRPs contain ASXXX instead of just XXX as the ASN
-// TODO: Use a regex to remove letter instead of assuming its the first two
-func asnToUint32(a string) uint32 {
-	n, err := strconv.Atoi(a[2:])
-	if err != nil {
-		log.Printf("Unable to convert ASN %s to int", a)
-		return 0
-	}
-
-	return uint32(n)
-}
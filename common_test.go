@@ -1,39 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/netip"
 	"os"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func TestAsnToInt(t *testing.T) {
-	tests := []struct {
-		desc    string
-		asnText string
-		want    uint32
-	}{
-		{
-			desc:    "test 1",
-			asnText: "AS123",
-			want:    123,
-		},
-		{
-			desc:    "test 2",
-			asnText: "word",
-			want:    0,
-		},
-	}
-	for _, v := range tests {
-		got := asnToUint32(v.asnText)
-		if got != v.want {
-			t.Errorf("Error on %s. Got %d, Want %d\n", v.desc, got, v.want)
-		}
-	}
-}
-
 func TestMakeDiff(t *testing.T) {
 	tests := []struct {
 		desc   string
@@ -264,7 +246,7 @@ func TestMakeDiff(t *testing.T) {
 		},
 	}
 	for _, v := range tests {
-		got := makeDiff(v.new, v.old, v.serial)
+		got := makeDiff(newVRPSet(v.new), newVRPSet(v.old), v.serial)
 		if !diffIsEqual(got, v.want) {
 			t.Errorf("Error on %s. got %#v, Want %#v\n", v.desc, got, v.want)
 		}
@@ -348,41 +330,55 @@ func TestReadROAs(t *testing.T) {
 	}{
 		{
 			desc: "first",
+			// Sets are sorted, IPv4 first.
 			wantInt: []roa{
 				{
 					Prefix:  netip.MustParsePrefix("1.0.0.0/24"),
 					MaxMask: 24,
 					ASN:     13335,
+					Expires: 1634998714,
+					TAs:     trustAnchors.bit("apnic"),
 				},
 				{
-					Prefix:  netip.MustParsePrefix("1.0.4.0/24"),
-					MaxMask: 24,
+					Prefix:  netip.MustParsePrefix("1.0.4.0/22"),
+					MaxMask: 22,
 					ASN:     38803,
+					Expires: 1634992687,
+					TAs:     trustAnchors.bit("apnic"),
 				},
 				{
-					Prefix:  netip.MustParsePrefix("1.0.4.0/22"),
-					MaxMask: 22,
+					Prefix:  netip.MustParsePrefix("1.0.4.0/24"),
+					MaxMask: 24,
 					ASN:     38803,
+					Expires: 1634992687,
+					TAs:     trustAnchors.bit("apnic"),
 				},
 				{
 					Prefix:  netip.MustParsePrefix("1.0.5.0/24"),
 					MaxMask: 24,
 					ASN:     38803,
+					Expires: 1634992687,
+					TAs:     trustAnchors.bit("apnic"),
+				},
+				{
+					Prefix:  netip.MustParsePrefix("2001:678:cdc::/48"),
+					MaxMask: 128,
+					ASN:     333333,
+					TAs:     trustAnchors.bit("ripe"),
 				},
 				{
 					Prefix:  netip.MustParsePrefix("2c0f:ffb8::/32"),
 					MaxMask: 32,
 					ASN:     37211,
+					Expires: 1634951748,
+					TAs:     trustAnchors.bit("afrinic"),
 				},
 				{
 					Prefix:  netip.MustParsePrefix("2c0f:ffe8::/32"),
 					MaxMask: 32,
 					ASN:     37443,
-				},
-				{
-					Prefix:  netip.MustParsePrefix("2001:678:cdc::/48"),
-					MaxMask: 128,
-					ASN:     333333,
+					Expires: 1634953218,
+					TAs:     trustAnchors.bit("afrinic"),
 				},
 			},
 			wantString: []roa{
@@ -390,49 +386,55 @@ func TestReadROAs(t *testing.T) {
 					Prefix:  netip.MustParsePrefix("1.0.0.0/24"),
 					MaxMask: 24,
 					ASN:     13335,
-				},
-				{
-					Prefix:  netip.MustParsePrefix("1.0.4.0/24"),
-					MaxMask: 24,
-					ASN:     38803,
+					TAs:     trustAnchors.bit("apnic"),
 				},
 				{
 					Prefix:  netip.MustParsePrefix("1.0.4.0/22"),
 					MaxMask: 23,
 					ASN:     38803,
+					TAs:     trustAnchors.bit("apnic"),
 				},
 				{
-					Prefix:  netip.MustParsePrefix("2001:678:cdc::/48"),
-					MaxMask: 128,
-					ASN:     210660,
+					Prefix:  netip.MustParsePrefix("1.0.4.0/24"),
+					MaxMask: 24,
+					ASN:     38803,
+					TAs:     trustAnchors.bit("apnic"),
 				},
 				{
 					Prefix:  netip.MustParsePrefix("50.128.0.0/9"),
 					MaxMask: 9,
 					ASN:     7922,
+					TAs:     trustAnchors.bit("arin"),
 				},
 				{
 					Prefix:  netip.MustParsePrefix("73.0.0.0/8"),
 					MaxMask: 9,
 					ASN:     7922,
+					TAs:     trustAnchors.bit("arin"),
+				},
+				{
+					Prefix:  netip.MustParsePrefix("2001:678:cdc::/48"),
+					MaxMask: 128,
+					ASN:     210660,
+					TAs:     trustAnchors.bit("ripe"),
 				},
 			},
 		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.desc, func(t *testing.T) {
-			got, err := readROAs([]string{"http://127.0.0.1:8181/int"})
+			set, _, err := readROAs(newSources([]sourceConfig{{url: "http://127.0.0.1:8181/int"}}), unionPolicy)
 			if err != nil {
 				panic(err)
 			}
-			if !reflect.DeepEqual(got, tc.wantInt) {
+			if got := set.roas(); !reflect.DeepEqual(got, tc.wantInt) {
 				t.Errorf("Got (%v), Wanted (%v) on int", got, tc.wantInt)
 			}
-			got, err = readROAs([]string{"http://127.0.0.1:8181/string"})
+			set, _, err = readROAs(newSources([]sourceConfig{{url: "http://127.0.0.1:8181/string"}}), unionPolicy)
 			if err != nil {
 				panic(err)
 			}
-			if !reflect.DeepEqual(got, tc.wantString) {
+			if got := set.roas(); !reflect.DeepEqual(got, tc.wantString) {
 				t.Errorf("Got (%v), Wanted (%v) on string", got, tc.wantString)
 			}
 		})
@@ -671,10 +673,206 @@ func BenchmarkMakeDiff(b *testing.B) {
 			},
 		}
 		for _, v := range tests {
-			got := makeDiff(v.new, v.old, v.serial)
+			got := makeDiff(newVRPSet(v.new), newVRPSet(v.old), v.serial)
 			if !diffIsEqual(got, v.want) {
 				b.Errorf("Error on %s. got %#v, Want %#v\n", v.desc, got, v.want)
 			}
 		}
 	}
 }
+
+// makeROAs returns n unique ROAs, half IPv4 and half IPv6. ROAs with the
+// same start value are the same across calls.
+func makeROAs(n, start int) []roa {
+	roas := make([]roa, 0, n)
+	for i := start; i < start+n/2; i++ {
+		v4 := netip.AddrFrom4([4]byte{byte(i >> 16), byte(i >> 8), byte(i), 0})
+		v6 := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(i >> 16), byte(i >> 8), byte(i)})
+		roas = append(roas,
+			roa{Prefix: netip.PrefixFrom(v4, 24), MaxMask: 24, ASN: uint32(i)},
+			roa{Prefix: netip.PrefixFrom(v6, 48), MaxMask: 48, ASN: uint32(i)},
+		)
+	}
+	return roas
+}
+
+// BenchmarkMakeDiffLarge diffs realistic sized sets where 1% of ROAs have
+// been replaced.
+func BenchmarkMakeDiffLarge(b *testing.B) {
+	for _, n := range []int{10000, 100000, 500000} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			old := newVRPSet(makeROAs(n, 0))
+			new := newVRPSet(makeROAs(n, n/200))
+			b.ReportAllocs()
+			for b.Loop() {
+				makeDiff(new, old, 1)
+			}
+		})
+	}
+}
+
+// BenchmarkSendRoa measures a full sync of 500k VRPs to a local client. The
+// PDUs are encoded once per snapshot and then reused by every client, so cold
+// is the first client after an update and cached every one after it.
+func BenchmarkSendRoa(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	vrps := newVRPSet(makeROAs(500000, 0))
+	// cache response + 250k IPv4 + 250k IPv6 + end of data
+	size := int64(8 + 250000*20 + 250000*32 + 24)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	router, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer router.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var current atomic.Pointer[snapshot]
+	current.Store(newSnapshot(vrps, 1, 1, serialDiff{}))
+	c := &client{
+		conn:    conn,
+		current: &current,
+		queue:   make(chan response, clientQueueSize),
+		done:    make(chan struct{}),
+	}
+	c.version.Store(uint32(version1))
+	go c.writer()
+	defer c.close()
+
+	for _, cold := range []bool{false, true} {
+		name := "cached"
+		if cold {
+			name = "cold"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(size)
+			for b.Loop() {
+				if cold {
+					current.Store(newSnapshot(vrps, 1, 1, serialDiff{}))
+				}
+				c.sendRoa()
+				if _, err := io.CopyN(io.Discard, router, size); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeROAs(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   string
+		want    []roa
+		wantErr bool
+	}{
+		{
+			desc: "numeric and string asn",
+			input: `{"metadata": {"buildtime": "2021-10-21T23:33:14Z", "counts": [1, 2]},
+				"roas": [
+					{"asn": 13335, "prefix": "1.0.0.0/24", "maxLength": 24, "ta": "apnic"},
+					{"asn": "AS38803", "prefix": "2001:db8::/32", "maxLength": 48}
+				]}`,
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("1.0.0.0/24"), MaxMask: 24, ASN: 13335, TAs: trustAnchors.bit("apnic")},
+				{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 38803},
+			},
+		},
+		{
+			desc:  "bad prefix is skipped",
+			input: `{"roas": [{"asn": 1, "prefix": "1.0.0.0/33", "maxLength": 24}, {"asn": 2, "prefix": "1.0.0.0/24", "maxLength": 24}]}`,
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("1.0.0.0/24"), MaxMask: 24, ASN: 2},
+			},
+		},
+		{
+			desc:    "truncated",
+			input:   `{"roas": [{"asn": 1, "prefix": "1.0.0.0/24", "maxLength": 24}`,
+			wantErr: true,
+		},
+		{
+			desc:    "roas not an array",
+			input:   `{"roas": {}}`,
+			wantErr: true,
+		},
+		{
+			desc: "whole float asn",
+			input: `{"roas": [{"asn": 13335.0, "prefix": "1.0.0.0/24", "maxLength": 24},
+				{"asn": 3.8803e4, "prefix": "2001:db8::/32", "maxLength": 48}]}`,
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("1.0.0.0/24"), MaxMask: 24, ASN: 13335},
+				{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 38803},
+			},
+		},
+		{
+			desc: "bad asns are skipped",
+			input: `{"roas": [{"asn": -1, "prefix": "1.0.0.0/24", "maxLength": 24},
+				{"asn": null, "prefix": "1.0.1.0/24", "maxLength": 24},
+				{"asn": 1.5, "prefix": "1.0.2.0/24", "maxLength": 24},
+				{"asn": 4294967296, "prefix": "1.0.3.0/24", "maxLength": 24},
+				{"asn": 1, "prefix": 24, "maxLength": 24},
+				{"asn": "", "prefix": "1.0.5.0/24", "maxLength": 24},
+				{"asn": "5", "prefix": "1.0.6.0/24", "maxLength": 24},
+				{"asn": "AS", "prefix": "1.0.7.0/24", "maxLength": 24},
+				{"asn": "AS4294967296", "prefix": "1.0.8.0/24", "maxLength": 24},
+				{"asn": 2, "prefix": "1.0.4.0/24", "maxLength": 24}]}`,
+			want: []roa{
+				{Prefix: netip.MustParsePrefix("1.0.4.0/24"), MaxMask: 24, ASN: 2},
+				{Prefix: netip.MustParsePrefix("1.0.6.0/24"), MaxMask: 24, ASN: 5},
+			},
+		},
+	}
+	for _, v := range tests {
+		var set vrpSet
+		err := decodeROAs(strings.NewReader(v.input), &set, nil)
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+			continue
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		set.normalize()
+		if got := set.roas(); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+		}
+	}
+}
+
+// BenchmarkDecodeROAs decodes a 500k VRP feed.
+func BenchmarkDecodeROAs(b *testing.B) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"metadata": {"buildtime": "2021-10-21T23:33:14Z"}, "roas": [`)
+	for i, r := range makeROAs(500000, 0) {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"asn": "AS%d", "prefix": "%s", "maxLength": %d, "ta": "ripe", "expires": 1634998714}`,
+			r.ASN, r.Prefix, r.MaxMask)
+	}
+	buf.WriteString("]}")
+	feed := buf.Bytes()
+
+	b.SetBytes(int64(len(feed)))
+	b.ReportAllocs()
+	for b.Loop() {
+		var set vrpSet
+		if err := decodeROAs(bytes.NewReader(feed), &set, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// config holds everything read from config.ini.
+type config struct {
+	log        string
+	listen     []string
+	http       string
+	state      string
+	aggregate  bool
+	thresholds thresholds
+	merge      mergePolicy
+	filters    *filterChain
+	slurm      *slurm
+	privileges privileges
+	// sources are the [source.NAME] sections. URLs given with -urls are
+	// added with the fetch defaults.
+	sources []sourceConfig
+	fetch   sourceConfig
+	// stateMaxAge is how old a state file can be and still be loaded.
+	stateMaxAge time.Duration
+	// admin is where quarantined updates are approved, with adminToken.
+	admin      string
+	adminToken string
+}
+
+// sourceConfig is how a single source is fetched.
+type sourceConfig struct {
+	name    string
+	url     string
+	timeout time.Duration
+	maxSize int64
+	retries int
+	// format is detected from the data if empty.
+	format string
+	// maxAge is how old the feed's own generated time can be. A stale
+	// source is left out, or only alerted on with alertStale.
+	maxAge     time.Duration
+	alertStale bool
+	// roots checks rtrs:// upstreams, with the system roots if nil.
+	roots *x509.CertPool
+}
+
+const (
+	defaultFetchTimeout = 2 * time.Minute
+	defaultMaxSize      = 512 << 20
+	defaultRetries      = 3
+	defaultStateMaxAge  = 24 * time.Hour
+)
+
+// loadConfig will read in the config file at path.
+func loadConfig(path string) (*config, error) {
+	cf, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	sec := cf.Section("rpkirtr")
+
+	c := &config{
+		log:   sec.Key("log").String(),
+		http:  sec.Key("http").String(),
+		state: sec.Key("state").String(),
+		privileges: privileges{
+			user:    sec.Key("user").String(),
+			group:   sec.Key("group").String(),
+			chroot:  sec.Key("chroot").String(),
+			workdir: sec.Key("workdir").String(),
+		},
+	}
+
+	c.admin = sec.Key("admin").String()
+	c.adminToken = sec.Key("admin_token").String()
+	if c.admin != "" && c.adminToken == "" {
+		return nil, fmt.Errorf("admin needs an admin_token")
+	}
+
+	c.stateMaxAge = defaultStateMaxAge
+	if sec.HasKey("state_max_age") {
+		if c.stateMaxAge, err = sec.Key("state_max_age").Duration(); err != nil || c.stateMaxAge < 0 {
+			return nil, fmt.Errorf("state_max_age needs to be a duration like 24h")
+		}
+	}
+
+	if sec.HasKey("aggregate") {
+		if c.aggregate, err = sec.Key("aggregate").Bool(); err != nil {
+			return nil, fmt.Errorf("aggregate needs to be true or false: %v", err)
+		}
+	}
+
+	if c.merge, err = parseMergePolicy(sec.Key("merge").String()); err != nil {
+		return nil, err
+	}
+	if fo := c.merge.failover; fo != nil {
+		if sec.HasKey("failback") {
+			if fo.failback, err = sec.Key("failback").Int(); err != nil || fo.failback < 1 {
+				return nil, fmt.Errorf("failback needs to be a number of at least 1")
+			}
+		}
+		if sec.HasKey("stale_after") {
+			if fo.staleAfter, err = sec.Key("stale_after").Duration(); err != nil || fo.staleAfter < 0 {
+				return nil, fmt.Errorf("stale_after needs to be a duration like 2h")
+			}
+		}
+	}
+
+	c.filters, err = parseFilters(
+		splitList(sec.Key("filters").String()),
+		splitList(sec.Key("ta_include").String()),
+		splitList(sec.Key("ta_exclude").String()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// SLURM files are read once the server is running.
+	c.slurm = newSLURM(splitList(sec.Key("slurm").String()))
+
+	// Never serve an empty set unless asked to.
+	c.thresholds.minVRPs = 1
+	if sec.HasKey("min_vrps") {
+		if c.thresholds.minVRPs, err = sec.Key("min_vrps").Int(); err != nil || c.thresholds.minVRPs < 0 {
+			return nil, fmt.Errorf("min_vrps needs to be a number")
+		}
+	}
+	for key, pct := range map[string]*float64{
+		"max_withdraw": &c.thresholds.maxWithdraw,
+		"max_add":      &c.thresholds.maxAdd,
+	} {
+		if !sec.HasKey(key) {
+			continue
+		}
+		if *pct, err = sec.Key(key).Float64(); err != nil || *pct < 0 {
+			return nil, fmt.Errorf("%s needs to be a percentage", key)
+		}
+	}
+
+	// Fetch defaults can be set in the main section, and overridden for each
+	// source.
+	if c.fetch, err = readSourceConfig(sec, sourceConfig{
+		timeout: defaultFetchTimeout,
+		maxSize: defaultMaxSize,
+		retries: defaultRetries,
+	}); err != nil {
+		return nil, err
+	}
+	for _, child := range cf.Section("source").ChildSections() {
+		src, err := readSourceConfig(child, c.fetch)
+		if err != nil {
+			return nil, err
+		}
+		src.name = strings.TrimPrefix(child.Name(), "source.")
+		if src.url = child.Key("url").String(); src.url == "" {
+			return nil, fmt.Errorf("source %s has no url", src.name)
+		}
+		c.sources = append(c.sources, src)
+	}
+
+	// listen is a list of addresses to bind. If not set, fall back to the
+	// older port option which binds all addresses.
+	for _, addr := range sec.Key("listen").Strings(",") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		c.listen = append(c.listen, addr)
+	}
+	if len(c.listen) == 0 {
+		port, err := sec.Key("port").Int64()
+		if err != nil {
+			return nil, fmt.Errorf("port set needs to be a number: %v", err)
+		}
+		c.listen = append(c.listen, fmt.Sprintf(":%d", port))
+	}
+
+	return c, nil
+}
+
+// readSourceConfig reads the fetch settings in sec, using def for any that
+// aren't set.
+func readSourceConfig(sec *ini.Section, def sourceConfig) (sourceConfig, error) {
+	src := def
+	if sec.HasKey("timeout") {
+		d, err := sec.Key("timeout").Duration()
+		if err != nil || d <= 0 {
+			return src, fmt.Errorf("timeout in [%s] needs to be a duration like 30s", sec.Name())
+		}
+		src.timeout = d
+	}
+	if sec.HasKey("max_size") {
+		mb, err := sec.Key("max_size").Int64()
+		if err != nil || mb <= 0 {
+			return src, fmt.Errorf("max_size in [%s] needs to be a number of MiB", sec.Name())
+		}
+		src.maxSize = mb << 20
+	}
+	if sec.HasKey("format") {
+		f, err := parseFormat(sec.Key("format").String())
+		if err != nil {
+			return src, fmt.Errorf("format in [%s]: %w", sec.Name(), err)
+		}
+		src.format = f
+	}
+	if sec.HasKey("max_age") {
+		d, err := sec.Key("max_age").Duration()
+		if err != nil || d < 0 {
+			return src, fmt.Errorf("max_age in [%s] needs to be a duration like 2h", sec.Name())
+		}
+		src.maxAge = d
+	}
+	if sec.HasKey("on_stale") {
+		switch v := strings.ToLower(sec.Key("on_stale").String()); v {
+		case "exclude":
+			src.alertStale = false
+		case "alert":
+			src.alertStale = true
+		default:
+			return src, fmt.Errorf("on_stale in [%s] needs to be exclude or alert, not %q", sec.Name(), v)
+		}
+	}
+	if sec.HasKey("ca_file") {
+		pem, err := os.ReadFile(sec.Key("ca_file").String())
+		if err != nil {
+			return src, fmt.Errorf("ca_file in [%s]: %w", sec.Name(), err)
+		}
+		src.roots = x509.NewCertPool()
+		if !src.roots.AppendCertsFromPEM(pem) {
+			return src, fmt.Errorf("ca_file in [%s] has no certificates", sec.Name())
+		}
+	}
+	if sec.HasKey("retries") {
+		n, err := sec.Key("retries").Int()
+		if err != nil || n < 0 {
+			return src, fmt.Errorf("retries in [%s] needs to be a number", sec.Name())
+		}
+		src.retries = n
+	}
+	return src, nil
+}
+
+// urlSources returns a source for each of urls with the fetch defaults.
+func (c *config) urlSources(urls []string) []sourceConfig {
+	var sources []sourceConfig
+	for _, url := range urls {
+		src := c.fetch
+		src.name, src.url = url, url
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		desc       string
+		file       string
+		wantListen []string
+		wantErr    bool
+	}{
+		{
+			desc:       "port only",
+			file:       "[rpkirtr]\nport = 8282\nlog = /tmp/rpkirtr.log\n",
+			wantListen: []string{":8282"},
+		},
+		{
+			desc:       "listen overrides port",
+			file:       "[rpkirtr]\nport = 8282\nlisten = 192.0.2.1:323, [2001:db8::1]:323\n",
+			wantListen: []string{"192.0.2.1:323", "[2001:db8::1]:323"},
+		},
+		{
+			desc:    "listen address without port",
+			file:    "[rpkirtr]\nlisten = 192.0.2.1\n",
+			wantErr: true,
+		},
+		{
+			desc:    "aggregate is not a bool",
+			file:    "[rpkirtr]\nport = 8282\naggregate = sometimes\n",
+			wantErr: true,
+		},
+		{
+			desc:    "no port or listen",
+			file:    "[rpkirtr]\nlog = /tmp/rpkirtr.log\n",
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		path := filepath.Join(t.TempDir(), "config.ini")
+		if err := os.WriteFile(path, []byte(v.file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadConfig(path)
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+			continue
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(got.listen, v.wantListen) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got.listen, v.wantListen)
+		}
+	}
+}
+
+func TestLoadSources(t *testing.T) {
+	file := `[rpkirtr]
+port = 8282
+timeout = 1m
+retries = 5
+slurm = /etc/rpkirtr/a.json, /etc/rpkirtr/b.json
+
+[source.ripe]
+url = https://example.com/vrps.json
+max_size = 64
+max_age = 2h
+on_stale = alert
+
+[source.local]
+url = http://192.0.2.1/vrps.json.zst
+timeout = 10s
+retries = 0
+format = Routinator
+`
+	path := filepath.Join(t.TempDir(), "config.ini")
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	if wantSLURM := []string{"/etc/rpkirtr/a.json", "/etc/rpkirtr/b.json"}; got.slurm == nil || !reflect.DeepEqual(got.slurm.paths, wantSLURM) {
+		t.Errorf("Got SLURM %+v, Want %v", got.slurm, wantSLURM)
+	}
+	want := []sourceConfig{
+		{name: "ripe", url: "https://example.com/vrps.json", timeout: time.Minute, maxSize: 64 << 20, retries: 5, maxAge: 2 * time.Hour, alertStale: true},
+		{name: "local", url: "http://192.0.2.1/vrps.json.zst", timeout: 10 * time.Second, maxSize: defaultMaxSize, retries: 0, format: "json"},
+	}
+	got.sources = append(got.sources, got.urlSources([]string{"https://example.net/vrps.json"})...)
+	want = append(want, sourceConfig{
+		name:    "https://example.net/vrps.json",
+		url:     "https://example.net/vrps.json",
+		timeout: time.Minute,
+		maxSize: defaultMaxSize,
+		retries: 5,
+	})
+	if !reflect.DeepEqual(got.sources, want) {
+		t.Errorf("Got %+v, Want %+v", got.sources, want)
+	}
+
+	for _, bad := range []string{
+		"[rpkirtr]\nport = 8282\n[source.none]\ntimeout = 1m\n",
+		"[rpkirtr]\nport = 8282\ntimeout = soon\n",
+		"[rpkirtr]\nport = 8282\n[source.big]\nurl = http://example.com/\nmax_size = -1\n",
+		"[rpkirtr]\nport = 8282\n[source.xml]\nurl = http://example.com/\nformat = xml\n",
+		"[rpkirtr]\nport = 8282\nmax_age = 1h\non_stale = ignore\n",
+		"[rpkirtr]\nport = 8282\nfilters = bogons, martians\n",
+		"[rpkirtr]\nport = 8282\nstate_max_age = forever\n",
+		"[rpkirtr]\nport = 8282\nadmin = 127.0.0.1:8284\n",
+		"[rpkirtr]\nport = 8282\n[source.up]\nurl = rtrs://rtr.example.com\nca_file = /nonexistent/ca.pem\n",
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("Wanted an error loading %q, but none received", bad)
+		}
+	}
+}
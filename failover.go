@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailback = 3
+	// maxEvents is how many failover events are kept.
+	maxEvents = 100
+)
+
+// failover serves one source at a time, in the order they're configured. The
+// highest priority healthy source is used, falling back to the next when it
+// fails or goes stale. A higher priority source needs failback healthy
+// fetches in a row before it's switched back to.
+type failover struct {
+	failback int
+	// staleAfter is how old a source's Last-Modified can be before it's
+	// unhealthy. Zero turns this off.
+	staleAfter time.Duration
+
+	mutex    sync.Mutex
+	active   int
+	healthy  []int
+	switches int
+	events   []failoverEvent
+}
+
+// failoverEvent is a switch from one source to another.
+type failoverEvent struct {
+	Time   time.Time `json:"time"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+func newFailover() *failover {
+	return &failover{failback: defaultFailback}
+}
+
+// health returns why a source isn't healthy, or nil if it is. When the feed
+// says when it was generated that's used rather than Last-Modified.
+func (f *failover) health(src *source, err error, now time.Time) error {
+	if err != nil {
+		return err
+	}
+	if f.staleAfter == 0 {
+		return nil
+	}
+	src.mutex.Lock()
+	modified, err := http.ParseTime(src.lastModified)
+	if !src.meta.generated.IsZero() {
+		modified, err = src.meta.generated, nil
+	}
+	src.mutex.Unlock()
+	if err == nil && now.Sub(modified) > f.staleAfter {
+		return fmt.Errorf("last modified %v ago", now.Sub(modified).Round(time.Second))
+	}
+	return nil
+}
+
+// choose returns which source to serve, given why each isn't healthy. It
+// errors if none are. Only sources fetched this time count towards failback.
+func (f *failover) choose(sources []*source, unhealthy []error, fetched []bool) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if len(f.healthy) != len(sources) {
+		f.healthy = make([]int, len(sources))
+	}
+	for i, err := range unhealthy {
+		if !fetched[i] {
+			continue
+		}
+		if err != nil {
+			f.healthy[i] = 0
+		} else {
+			f.healthy[i]++
+		}
+	}
+
+	// Fall back straight away if the active source is unhealthy.
+	if err := unhealthy[f.active]; err != nil {
+		for i := range sources {
+			if unhealthy[i] == nil {
+				f.switchTo(sources, i, fmt.Sprintf("%s is unhealthy: %v", sources[f.active].name, err))
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("no healthy source, %s is unhealthy: %w", sources[f.active].name, err)
+	}
+
+	// Switch back to a higher priority source once it's proven itself.
+	for i := range f.active {
+		if f.healthy[i] >= f.failback {
+			f.switchTo(sources, i, fmt.Sprintf("%s has been healthy for %d fetches", sources[i].name, f.healthy[i]))
+			break
+		}
+	}
+	return f.active, nil
+}
+
+// switchTo makes source i active and records the event.
+func (f *failover) switchTo(sources []*source, i int, reason string) {
+	ev := failoverEvent{
+		Time:   time.Now(),
+		From:   sources[f.active].name,
+		To:     sources[i].name,
+		Reason: reason,
+	}
+	log.Printf("EVENT: switching source from %s to %s: %s\n", ev.From, ev.To, ev.Reason)
+	f.active = i
+	f.switches++
+	f.events = append(f.events, ev)
+	if len(f.events) > maxEvents {
+		f.events = f.events[len(f.events)-maxEvents:]
+	}
+}
+
+// status returns the active source, how many switches there have been and
+// the latest events.
+func (f *failover) status() (int, int, []failoverEvent) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.active, f.switches, append([]failoverEvent(nil), f.events...)
+}
+
+// eventsHandler lists the latest failover events.
+func (s *CacheServer) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	events := []failoverEvent{}
+	if s.merge.failover != nil {
+		_, _, events = s.merge.failover.status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		log.Printf("unable to write events response: %v\n", err)
+	}
+}
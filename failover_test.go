@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFailoverChoose(t *testing.T) {
+	sources := newSources([]sourceConfig{{url: "primary"}, {url: "secondary"}, {url: "tertiary"}})
+	fo := newFailover()
+	fo.failback = 2
+	down := errors.New("down")
+
+	steps := []struct {
+		desc      string
+		unhealthy []error
+		// fetched is every source if nil.
+		fetched []bool
+		want    int
+		wantErr bool
+	}{
+		{desc: "all healthy", unhealthy: []error{nil, nil, nil}, want: 0},
+		{desc: "primary fails", unhealthy: []error{down, nil, nil}, want: 1},
+		{desc: "secondary fails too", unhealthy: []error{down, down, nil}, want: 2},
+		{desc: "secondary recovers once", unhealthy: []error{down, nil, nil}, want: 2},
+		{desc: "secondary recovers twice", unhealthy: []error{down, nil, nil}, want: 1},
+		{desc: "primary recovers once", unhealthy: []error{nil, nil, nil}, want: 1},
+		{desc: "primary flaps", unhealthy: []error{down, nil, nil}, want: 1},
+		{desc: "primary recovers again", unhealthy: []error{nil, nil, nil}, want: 1},
+		{desc: "primary not fetched", unhealthy: []error{nil, nil, nil}, fetched: []bool{false, true, true}, want: 1},
+		{desc: "primary recovers twice", unhealthy: []error{nil, nil, nil}, want: 0},
+		{desc: "everything fails", unhealthy: []error{down, down, down}, wantErr: true},
+	}
+	for _, v := range steps {
+		fetched := v.fetched
+		if fetched == nil {
+			fetched = []bool{true, true, true}
+		}
+		got, err := fo.choose(sources, v.unhealthy, fetched)
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+		}
+		if err == nil && got != v.want {
+			t.Errorf("Error on %s. Got source %d, Want %d", v.desc, got, v.want)
+		}
+	}
+	if _, switches, events := fo.status(); switches != 4 || len(events) != 4 || events[3].To != "primary" {
+		t.Errorf("Got %d switches and events %+v, Want 4 ending on primary", switches, events)
+	}
+}
+
+func TestFailoverStale(t *testing.T) {
+	fo := newFailover()
+	fo.staleAfter = time.Hour
+	now := time.Now()
+	src := &source{}
+	for _, v := range []struct {
+		modified  string
+		wantStale bool
+	}{
+		{modified: "", wantStale: false},
+		{modified: now.Add(-time.Minute).UTC().Format(http.TimeFormat), wantStale: false},
+		{modified: now.Add(-2 * time.Hour).UTC().Format(http.TimeFormat), wantStale: true},
+	} {
+		src.lastModified = v.modified
+		if err := fo.health(src, nil, now); (err != nil) != v.wantStale {
+			t.Errorf("Last modified %q got %v, Want stale %t", v.modified, err, v.wantStale)
+		}
+	}
+}
+
+func TestReadROAsFailover(t *testing.T) {
+	primaryUp := true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/primary", func(w http.ResponseWriter, r *http.Request) {
+		if !primaryUp {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, "data/int.json")
+	})
+	mux.HandleFunc("/secondary", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/string.json")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	sources := newSources([]sourceConfig{{url: srv.URL + "/primary"}, {url: srv.URL + "/secondary"}})
+	policy, _ := parseMergePolicy("failover")
+	policy.failover.failback = 1
+
+	primary, _, err := readROAs(sources, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected := sources[1].lastStatus().rejected; rejected == 0 {
+		t.Errorf("Secondary VRPs were published along with the primary")
+	}
+
+	primaryUp = false
+	secondary, changed, err := readROAs(sources, policy)
+	if err != nil || !changed || secondary.len() == primary.len() {
+		t.Errorf("Did not fail over to the secondary: %d VRPs, changed %t, err %v", secondary.len(), changed, err)
+	}
+
+	// Switching back is a change, even with the primary unmodified.
+	primaryUp = true
+	got, changed, err := readROAs(sources, policy)
+	if err != nil || !changed || got.len() != primary.len() {
+		t.Errorf("Did not switch back to the primary: %d VRPs, changed %t, err %v", got.len(), changed, err)
+	}
+}
+
+func TestWatchedRefreshFailback(t *testing.T) {
+	primaryUp := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !primaryUp {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, "data/int.json")
+	}))
+	defer srv.Close()
+	feed := filepath.Join(t.TempDir(), "vrps.json")
+	writeFile(t, feed, vrpJSON("203.0.113.0/24"))
+
+	sources := newSources([]sourceConfig{{url: srv.URL}, {url: "file://" + feed}})
+	policy, _ := parseMergePolicy("failover")
+	policy.failover.failback = 2
+	active := func() int {
+		i, _, _ := policy.failover.status()
+		return i
+	}
+
+	readROAs(sources, policy)
+	primaryUp = false
+	readROAs(sources, policy)
+	if active() != 1 {
+		t.Fatalf("Did not fail over to the file")
+	}
+
+	// Refreshes of only the file don't count as healthy fetches of the
+	// primary, however many there are.
+	primaryUp = true
+	readROAs(sources, policy)
+	for range 3 {
+		if _, _, err := readSources(sources, policy, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if active() != 1 {
+		t.Errorf("Switched back to the primary after 1 fetch")
+	}
+	readROAs(sources, policy)
+	if active() != 0 {
+		t.Errorf("Did not switch back to the primary after 2 fetches")
+	}
+}
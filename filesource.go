@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// fileSettle is how long to wait after a change to a watched file before
+// refreshing, so a burst of changes only causes one refresh. Files are also
+// only read once they've been unchanged this long.
+const fileSettle = time.Second
+
+// settleTries is how many times to wait for a file that's still changing.
+const settleTries = 3
+
+var errNotSettled = errors.New("file is still being written")
+
+// fileState is what was last read from a local file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+	vrps    vrpSet
+	meta    metadata
+}
+
+// filePath returns the local path of a file:// source.
+func (src *source) filePath() (string, bool) {
+	u, err := url.Parse(src.url)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// ignoreFile is true for names editors and atomic writers use for files
+// that are still being written.
+func ignoreFile(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+		return true
+	}
+	switch filepath.Ext(name) {
+	case ".tmp", ".part", ".swp", ".partial":
+		return true
+	}
+	return false
+}
+
+// openRoot opens the directory a file:// source is read from. Like the state
+// file, this is done before dropping privileges so the path is outside of
+// any chroot. rootName is the file in it, or "." for the whole directory.
+func (src *source) openRoot(path string) error {
+	if src.root != nil {
+		return nil
+	}
+	dir, name := path, "."
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		dir, name = filepath.Dir(path), filepath.Base(path)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	src.root, src.rootName = root, name
+	return nil
+}
+
+// fetchFiles reads a file, or every file in a directory. Files which haven't
+// changed size or modification time aren't read again. In a directory, a
+// file that can't be decoded or is still being written is skipped, keeping
+// what was last read from it.
+func (src *source) fetchFiles(path string) (vrpSet, bool, error) {
+	if err := src.openRoot(path); err != nil {
+		return vrpSet{}, false, err
+	}
+	fi, err := src.root.Stat(src.rootName)
+	if err != nil {
+		return vrpSet{}, false, err
+	}
+	dir := fi.IsDir()
+	names := []string{src.rootName}
+	if dir {
+		entries, err := fs.ReadDir(src.root.FS(), src.rootName)
+		if err != nil {
+			return vrpSet{}, false, err
+		}
+		names = names[:0]
+		for _, e := range entries {
+			if e.Type().IsRegular() && !ignoreFile(e.Name()) {
+				names = append(names, e.Name())
+			}
+		}
+		if len(names) == 0 {
+			return vrpSet{}, false, fmt.Errorf("no files in %s", path)
+		}
+	}
+
+	files := make(map[string]fileState, len(names))
+	changed := len(names) != len(src.files)
+	var newest time.Time
+	var meta metadata
+	for _, name := range names {
+		st, err := src.readFile(name)
+		if err != nil {
+			prev, ok := src.files[name]
+			if !dir {
+				return vrpSet{}, false, err
+			}
+			log.Printf("ignoring %s for now: %v\n", filepath.Join(path, name), err)
+			if !ok {
+				continue
+			}
+			st = prev
+		}
+		if prev, ok := src.files[name]; !ok || !prev.modTime.Equal(st.modTime) || prev.size != st.size {
+			changed = true
+		}
+		files[name] = st
+		meta = meta.combine(st.meta)
+		if st.modTime.After(newest) {
+			newest = st.modTime
+		}
+	}
+	if len(files) == 0 {
+		return vrpSet{}, false, fmt.Errorf("no readable files in %s", path)
+	}
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	src.files = files
+	src.meta = meta
+	src.lastModified = newest.UTC().Format(http.TimeFormat)
+	if !changed {
+		return src.vrps, false, nil
+	}
+
+	// The cached sets mustn't be changed, so copy them in to a new one.
+	var vrps vrpSet
+	for _, k := range slices.Sorted(maps.Keys(files)) {
+		vrps.merge(files[k].vrps)
+	}
+	vrps.normalize()
+	src.vrps = vrps
+	log.Printf("Returning %d ROAs from %d files in %s\n", vrps.len(), len(files), src.name)
+	return vrps, true, nil
+}
+
+// readFile decodes a single file in the source's root, unless it's the same
+// as last time.
+func (src *source) readFile(name string) (fileState, error) {
+	f, err := src.root.Open(name)
+	if err != nil {
+		return fileState{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fileState{}, err
+	}
+	if prev, ok := src.files[name]; ok && prev.modTime.Equal(fi.ModTime()) && prev.size == fi.Size() {
+		return prev, nil
+	}
+	// A truncated file can still decode, so one that was changed within
+	// fileSettle may still be being written. Wait until it's settled.
+	for tries := 0; time.Since(fi.ModTime()) < fileSettle; tries++ {
+		if tries == settleTries {
+			return fileState{}, errNotSettled
+		}
+		time.Sleep(min(fileSettle-time.Since(fi.ModTime()), fileSettle))
+		if fi, err = f.Stat(); err != nil {
+			return fileState{}, err
+		}
+	}
+	if fi.Size() > src.maxSize {
+		return fileState{}, errTooLarge
+	}
+	vrps, meta, err := decodeFeed(f, name, src.format, src.maxSize)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: fi.ModTime(), size: fi.Size(), vrps: vrps, meta: meta}, nil
+}
+
+var errWatchUnsupported = errors.New("watching files is only supported on linux")
+
+// openFiles opens every file source and SLURM file, before dropping
+// privileges.
+func (s *CacheServer) openFiles() error {
+	for _, src := range s.sources {
+		if path, ok := src.filePath(); ok {
+			if err := src.openRoot(path); err != nil {
+				return fmt.Errorf("unable to open %s: %w", src.name, err)
+			}
+		}
+	}
+	return s.slurm.open()
+}
+
+// watchSources watches every file source, triggering a refresh soon after
+// one changes. SLURM files are watched the same way. Like openFiles, this is
+// done before dropping privileges.
+func (s *CacheServer) watchSources() {
+	for _, src := range s.sources {
+		if path, ok := src.filePath(); ok {
+			s.watchPath(src.name, path)
+		}
+	}
+	if s.slurm != nil {
+		for _, path := range s.slurm.paths {
+			s.watchPath(path, path)
+		}
+	}
+}
+
+// watchPath triggers a refresh when the file or directory at path changes.
+func (s *CacheServer) watchPath(label, path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		log.Printf("unable to watch %s: %v\n", label, err)
+		return
+	}
+	// Atomic writers replace the file, so watch the directory it's in.
+	dir, name := path, ""
+	if !fi.IsDir() {
+		dir, name = filepath.Dir(path), filepath.Base(path)
+	}
+	changes, err := watchDir(dir)
+	if err != nil {
+		log.Printf("unable to watch %s: %v\n", label, err)
+		return
+	}
+	log.Printf("Watching %s for changes\n", path)
+	go s.waitForChanges(changes, name)
+}
+
+// startUpstreams connects to every upstream RTR cache, each of which
+// triggers a refresh after every update.
+func (s *CacheServer) startUpstreams() {
+	for _, src := range s.sources {
+		if src.rtr != nil {
+			src.rtr.start()
+			go s.followUpstream(src.rtr)
+		}
+	}
+}
+
+// followUpstream triggers a refresh whenever the upstream cache has changed.
+func (s *CacheServer) followUpstream(c *rtrClient) {
+	for range c.updated {
+		select {
+		case s.refreshNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// waitForChanges triggers a refresh once changes to name have settled. An
+// empty name is any file in the directory.
+func (s *CacheServer) waitForChanges(changes <-chan string, name string) {
+	var settle <-chan time.Time
+	for {
+		select {
+		case changed, ok := <-changes:
+			if !ok {
+				return
+			}
+			if ignoreFile(changed) || (name != "" && changed != name) {
+				continue
+			}
+			settle = time.After(fileSettle)
+		case <-settle:
+			settle = nil
+			select {
+			case s.refreshNow <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
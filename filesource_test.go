@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFile replaces name atomically with a rename, like a validator would.
+// It's dated fileSettle ago, so it's read without waiting.
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err := os.WriteFile(tmp, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-fileSettle)
+	if err := os.Chtimes(tmp, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func vrpJSON(prefixes ...string) string {
+	s := `{"roas": [`
+	for i, p := range prefixes {
+		if i > 0 {
+			s += ","
+		}
+		s += `{"asn": "AS64496", "prefix": "` + p + `", "maxLength": 24}`
+	}
+	return s + "]}"
+}
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "vrps.json")
+	writeFile(t, name, vrpJSON("192.0.2.0/24"))
+	src := newSources([]sourceConfig{{url: "file://" + name}})[0]
+
+	steps := []struct {
+		desc        string
+		data        string
+		wantVRPs    int
+		wantChanged bool
+		wantErr     bool
+	}{
+		{desc: "first read", wantVRPs: 1, wantChanged: true},
+		{desc: "unchanged", wantVRPs: 1},
+		{desc: "replaced", data: vrpJSON("192.0.2.0/24", "198.51.100.0/24"), wantVRPs: 2, wantChanged: true},
+		{desc: "broken", data: `{"roas": [`, wantErr: true},
+	}
+	for i, v := range steps {
+		if v.data != "" {
+			writeFile(t, name, v.data)
+			// Make sure the modification time moves on.
+			os.Chtimes(name, time.Now(), time.Now().Add(time.Duration(i-10)*time.Second))
+		}
+		vrps, changed, err := src.fetchOnce()
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+		}
+		if err == nil && (vrps.len() != v.wantVRPs || changed != v.wantChanged) {
+			t.Errorf("Error on %s. Got %d VRPs changed %t, Want %d changed %t", v.desc, vrps.len(), changed, v.wantVRPs, v.wantChanged)
+		}
+	}
+}
+
+func TestDirectorySource(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "one.json"), vrpJSON("192.0.2.0/24"))
+	writeFile(t, filepath.Join(dir, "two.json"), vrpJSON("198.51.100.0/24", "192.0.2.0/24"))
+	// Files still being written are left alone.
+	os.WriteFile(filepath.Join(dir, "three.json.tmp"), []byte(`{"roas": [`), 0o644)
+	os.WriteFile(filepath.Join(dir, ".four.json"), []byte(`{"roas": [`), 0o644)
+
+	src := newSources([]sourceConfig{{url: "file://" + dir}})[0]
+	vrps, changed, err := src.fetchOnce()
+	if err != nil || !changed || vrps.len() != 2 {
+		t.Fatalf("Got %d VRPs changed %t err %v, Want 2 changed", vrps.len(), changed, err)
+	}
+
+	// A half written file keeps what was last read from it.
+	writeFile(t, filepath.Join(dir, "one.json"), `{"roas": [{"asn": 1,`)
+	os.Chtimes(filepath.Join(dir, "one.json"), time.Now(), time.Now().Add(-2*fileSettle))
+	vrps, changed, err = src.fetchOnce()
+	if err != nil || changed || vrps.len() != 2 {
+		t.Errorf("Half written file: got %d VRPs changed %t err %v, Want 2 unchanged", vrps.len(), changed, err)
+	}
+
+	// A new file is picked up.
+	writeFile(t, filepath.Join(dir, "five.json"), vrpJSON("203.0.113.0/24"))
+	vrps, changed, err = src.fetchOnce()
+	if err != nil || !changed || vrps.len() != 3 {
+		t.Errorf("New file: got %d VRPs changed %t err %v, Want 3 changed", vrps.len(), changed, err)
+	}
+
+	// A truncated CSV file decodes fine, so a file written in place is only
+	// read once it has settled.
+	csv := filepath.Join(dir, "six.csv")
+	if err := os.WriteFile(csv, []byte("ASN,IP Prefix,Max Length,Trust Anchor\nAS64496,192.0.2.128/25,25,ripe\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(fileSettle / 2)
+		f, err := os.OpenFile(csv, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		f.WriteString("AS64496,198.51.100.128/25,25,ripe\n")
+		f.Close()
+	}()
+	vrps, changed, err = src.fetchOnce()
+	if err != nil || !changed || vrps.len() != 5 {
+		t.Errorf("File written in place: got %d VRPs changed %t err %v, Want 5 changed", vrps.len(), changed, err)
+	}
+}
+
+func TestFileSourceRoot(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "vrps")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "one.json"), vrpJSON("192.0.2.0/24"))
+	src := newSources([]sourceConfig{{url: "file://" + dir}})[0]
+	if err := (&CacheServer{sources: []*source{src}}).openFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once opened, the directory is still read when its path has gone, as it
+	// has after a chroot.
+	moved := filepath.Join(base, "moved")
+	if err := os.Rename(dir, moved); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(moved, "two.json"), vrpJSON("198.51.100.0/24"))
+	vrps, changed, err := src.fetchOnce()
+	if err != nil || !changed || vrps.len() != 2 {
+		t.Errorf("Got %d VRPs changed %t err %v, Want 2 changed", vrps.len(), changed, err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// filterRule is one step of the filter chain. keep returns false to drop a
+// VRP, and may change its origin.
+type filterRule struct {
+	name string
+	keep func(r *roa) bool
+}
+
+// filterChain is local policy, applied in order to the validated VRPs of
+// every update before they're aggregated and published. Each rule counts how
+// many VRPs it filtered from the last update.
+type filterChain struct {
+	rules []filterRule
+
+	mutex  sync.Mutex
+	counts []int
+}
+
+// filterCount is how many VRPs a rule filtered.
+type filterCount struct {
+	rule  string
+	count int
+}
+
+// bogons are the special purpose blocks from RFC 6890 that aren't globally
+// reachable, along with multicast and the later local-use NAT64 (RFC 8215),
+// SRv6 SID (RFC 9602) and documentation (RFC 9637) blocks. VRPs within them
+// are never needed.
+var bogons = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:2::/48"),
+	netip.MustParsePrefix("2001:10::/28"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("3fff::/20"),
+	netip.MustParsePrefix("5f00::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// isBogon reports whether p is within one of the bogons.
+func isBogon(p netip.Prefix) bool {
+	for _, b := range bogons {
+		if p.Bits() >= b.Bits() && b.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateASN reports whether asn is private, reserved or for documentation
+// (RFC 5398, 6793, 6996 and 7300). AS0 is handled on its own.
+func isPrivateASN(asn uint32) bool {
+	switch {
+	case asn == 23456:
+		return true
+	case asn >= 64496 && asn <= 131071:
+		return true
+	case asn >= 4200000000:
+		return true
+	}
+	return false
+}
+
+// parseFilters builds the chain from a list of rules, which are:
+//
+//	ta             keep only include, and drop exclude, trust anchors
+//	bogons         drop VRPs for special purpose address space
+//	as0:keep|drop  how AS0 VRPs (RFC 7607) are handled, drop if not given
+//	private_asn:drop|clamp
+//	               drop VRPs for private and reserved ASNs, or clamp them to
+//	               AS0 so matching routes are invalid rather than unknown
+func parseFilters(rules, include, exclude []string) (*filterChain, error) {
+	c := &filterChain{}
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		name, arg, _ := strings.Cut(rule, ":")
+		if seen[name] {
+			return nil, fmt.Errorf("filter %s is given twice", name)
+		}
+		seen[name] = true
+
+		switch {
+		case name == "ta" && arg == "":
+			if len(include) == 0 && len(exclude) == 0 {
+				return nil, fmt.Errorf("the ta filter needs ta_include or ta_exclude")
+			}
+			c.rules = append(c.rules, taFilter(include, exclude))
+		case name == "bogons" && arg == "":
+			c.rules = append(c.rules, filterRule{name: name, keep: func(r *roa) bool {
+				return !isBogon(r.Prefix)
+			}})
+		case name == "as0" && arg == "keep":
+		case name == "as0" && (arg == "" || arg == "drop"):
+			c.rules = append(c.rules, filterRule{name: name, keep: func(r *roa) bool {
+				return r.ASN != 0
+			}})
+		case name == "private_asn" && (arg == "" || arg == "drop"):
+			c.rules = append(c.rules, filterRule{name: name, keep: func(r *roa) bool {
+				return !isPrivateASN(r.ASN)
+			}})
+		case name == "private_asn" && arg == "clamp":
+			c.rules = append(c.rules, filterRule{name: name, keep: func(r *roa) bool {
+				if isPrivateASN(r.ASN) {
+					r.ASN = 0
+				}
+				return true
+			}})
+		default:
+			return nil, fmt.Errorf("unknown filter %q", rule)
+		}
+	}
+	if (len(include) > 0 || len(exclude) > 0) && !seen["ta"] {
+		return nil, fmt.Errorf("ta_include and ta_exclude need ta in filters")
+	}
+	c.counts = make([]int, len(c.rules))
+	return c, nil
+}
+
+// taFilter keeps VRPs issued under any included trust anchor, unless every
+// trust anchor it was issued under is excluded. With an include list, VRPs
+// with no known trust anchor are dropped.
+func taFilter(include, exclude []string) filterRule {
+	in, out := trustAnchors.mask(include), trustAnchors.mask(exclude)
+	return filterRule{name: "ta", keep: func(r *roa) bool {
+		if len(include) > 0 && r.TAs&in == 0 {
+			return false
+		}
+		return r.TAs == 0 || r.TAs&^out != 0
+	}}
+}
+
+// apply returns the VRPs the chain keeps. s isn't changed.
+func (c *filterChain) apply(s vrpSet) vrpSet {
+	if c == nil || len(c.rules) == 0 {
+		return s
+	}
+	counts := make([]int, len(c.rules))
+	var out vrpSet
+	out.v4 = make([]vrp4, 0, len(s.v4))
+	out.v6 = make([]vrp6, 0, len(s.v6))
+	var clamped bool
+next:
+	for r := range s.all() {
+		asn := r.ASN
+		for i, rule := range c.rules {
+			if !rule.keep(&r) {
+				counts[i]++
+				continue next
+			}
+			if r.ASN != asn {
+				counts[i]++
+				clamped = true
+				asn = r.ASN
+			}
+		}
+		out.add(r)
+	}
+	// A changed origin moves the VRP, and may make it a duplicate.
+	if clamped {
+		out.normalize()
+	}
+
+	c.mutex.Lock()
+	c.counts = counts
+	c.mutex.Unlock()
+	return out
+}
+
+// status returns how many VRPs each rule filtered from the last update.
+func (c *filterChain) status() []filterCount {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	out := make([]filterCount, len(c.rules))
+	for i, rule := range c.rules {
+		out[i] = filterCount{rule: rule.name, count: c.counts[i]}
+	}
+	return out
+}
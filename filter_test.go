@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestFilterChain(t *testing.T) {
+	ripe, arin := trustAnchors.bit("ripe"), trustAnchors.bit("arin")
+	both := roa{Prefix: netip.MustParsePrefix("193.0.0.0/21"), MaxMask: 21, ASN: 3333, TAs: ripe | arin}
+	onlyRIPE := roa{Prefix: netip.MustParsePrefix("193.0.8.0/24"), MaxMask: 24, ASN: 3333, TAs: ripe}
+	onlyARIN := roa{Prefix: netip.MustParsePrefix("8.8.8.0/24"), MaxMask: 24, ASN: 15169, TAs: arin}
+	unknown := roa{Prefix: netip.MustParsePrefix("1.1.1.0/24"), MaxMask: 24, ASN: 13335}
+	bogon := roa{Prefix: netip.MustParsePrefix("10.1.0.0/16"), MaxMask: 24, ASN: 3333, TAs: ripe}
+	bogon6 := roa{Prefix: netip.MustParsePrefix("2001:db8:1::/48"), MaxMask: 48, ASN: 3333, TAs: ripe}
+	as0 := roa{Prefix: netip.MustParsePrefix("193.0.16.0/24"), MaxMask: 24, ASN: 0, TAs: ripe}
+	private := roa{Prefix: netip.MustParsePrefix("193.0.16.0/24"), MaxMask: 24, ASN: 64512, TAs: arin}
+	input := newVRPSet([]roa{both, onlyRIPE, onlyARIN, unknown, bogon, bogon6, as0, private})
+	clamped := as0
+	clamped.TAs = ripe | arin
+
+	tests := []struct {
+		desc    string
+		rules   []string
+		include []string
+		exclude []string
+		want    []roa
+		counts  []int
+		wantErr bool
+	}{
+		{
+			desc: "no filters",
+			want: input.roas(),
+		},
+		{
+			desc:    "exclude a trust anchor",
+			rules:   []string{"ta"},
+			exclude: []string{"ARIN"},
+			want:    []roa{unknown, bogon, both, onlyRIPE, as0, bogon6},
+			counts:  []int{2},
+		},
+		{
+			desc:    "include a trust anchor",
+			rules:   []string{"ta"},
+			include: []string{"arin"},
+			want:    []roa{onlyARIN, both, private},
+			counts:  []int{5},
+		},
+		{
+			desc:   "bogons",
+			rules:  []string{"bogons"},
+			want:   []roa{unknown, onlyARIN, both, onlyRIPE, as0, private},
+			counts: []int{2},
+		},
+		{
+			desc:   "as0 and private asns dropped",
+			rules:  []string{"as0", "private_asn"},
+			want:   []roa{unknown, onlyARIN, bogon, both, onlyRIPE, bogon6},
+			counts: []int{1, 1},
+		},
+		{
+			desc:   "private asns clamped to an existing as0",
+			rules:  []string{"as0:keep", "private_asn:clamp"},
+			want:   []roa{unknown, onlyARIN, bogon, both, onlyRIPE, clamped, bogon6},
+			counts: []int{1},
+		},
+		{
+			desc:   "clamped then dropped",
+			rules:  []string{"private_asn:clamp", "as0:drop"},
+			want:   []roa{unknown, onlyARIN, bogon, both, onlyRIPE, bogon6},
+			counts: []int{1, 2},
+		},
+		{desc: "unknown filter", rules: []string{"rfc1918"}, wantErr: true},
+		{desc: "unknown option", rules: []string{"as0:maybe"}, wantErr: true},
+		{desc: "repeated filter", rules: []string{"bogons", "bogons"}, wantErr: true},
+		{desc: "ta without lists", rules: []string{"ta"}, wantErr: true},
+		{desc: "lists without ta", include: []string{"ripe"}, wantErr: true},
+	}
+	for _, v := range tests {
+		c, err := parseFilters(v.rules, v.include, v.exclude)
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+		}
+		if err != nil {
+			continue
+		}
+		before := input.roas()
+		if got := c.apply(input).roas(); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+		}
+		if !reflect.DeepEqual(input.roas(), before) {
+			t.Errorf("Error on %s. Input was changed", v.desc)
+		}
+		var counts []int
+		for _, f := range c.status() {
+			counts = append(counts, f.count)
+		}
+		if !reflect.DeepEqual(counts, v.counts) {
+			t.Errorf("Error on %s. Got counts %v, Want %v", v.desc, counts, v.counts)
+		}
+	}
+}
+
+func TestIsBogon(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		want   bool
+	}{
+		{"10.0.0.0/8", true},
+		{"192.0.2.0/24", true},
+		{"193.0.0.0/21", false},
+		{"2001:db8:1::/48", true},
+		{"2001:2::/48", true},
+		{"2001:10::/32", true},
+		// Other parts of 2001::/23 are globally reachable, like AS112.
+		{"2001:4:112::/48", false},
+		{"2001:20::/28", false},
+		{"2001::/32", false},
+		{"2001::/23", false},
+		{"2a00::/12", false},
+		{"64:ff9b:1::/48", true},
+		{"64:ff9b:1:a::/64", true},
+		{"5f00::/16", true},
+		{"5f00:1::/32", true},
+		{"3fff::/20", true},
+		{"3fff:fff::/32", true},
+		// The well-known NAT64 prefix is globally reachable.
+		{"64:ff9b::/96", false},
+		{"3fff:1000::/20", false},
+		{"5f01::/16", false},
+	} {
+		if got := isBogon(netip.MustParsePrefix(tc.prefix)); got != tc.want {
+			t.Errorf("%s: Got %t, Want %t", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestTrustAnchors(t *testing.T) {
+	r := newTARegistry("ripe")
+	if r.bit("RIPE") != 1 || r.bit("arin") != 2 || r.bit("") != 0 {
+		t.Errorf("Unexpected bits for ripe %d, arin %d", r.bit("ripe"), r.bit("arin"))
+	}
+	if got := r.lookup(3); !reflect.DeepEqual(got, []string{"ripe", "arin"}) {
+		t.Errorf("Got %v, Want ripe and arin", got)
+	}
+
+	// Duplicates from different trust anchors are merged.
+	p := netip.MustParsePrefix("193.0.0.0/21")
+	set := newVRPSet([]roa{
+		{Prefix: p, MaxMask: 21, ASN: 3333, TAs: 1},
+		{Prefix: p, MaxMask: 21, ASN: 3333, TAs: 2},
+	})
+	if got := set.roas(); len(got) != 1 || got[0].TAs != 3 {
+		t.Errorf("Got %v, Want one VRP from both trust anchors", got)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// parser reads VRPs in one format, adding each to set. Any metadata the
+// format has goes in meta, which may be nil.
+type parser func(r io.Reader, set *vrpSet, meta *metadata) error
+
+// parsers are the formats a source can be in. Routinator, rpki-client and
+// the RIPE NCC validator all write their JSON and CSV in the same shape, so
+// the aliases are only for clarity in config.
+var parsers = map[string]parser{
+	"json":     decodeROAs,
+	"csv":      decodeCSV,
+	"openbgpd": decodeRoaSet,
+}
+
+var formatAliases = map[string]string{
+	"rpki-client":      "json",
+	"routinator":       "json",
+	"ripe":             "json",
+	"rpki-client-json": "json",
+	"routinator-json":  "json",
+	"ripe-json":        "json",
+	"rpki-client-csv":  "csv",
+	"routinator-csv":   "csv",
+	"ripe-csv":         "csv",
+	"roa-set":          "openbgpd",
+	"bgpd":             "openbgpd",
+}
+
+// parseFormat returns the name of a format, or "" to detect it.
+func parseFormat(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "auto" {
+		return "", nil
+	}
+	if alias, ok := formatAliases[s]; ok {
+		s = alias
+	}
+	if _, ok := parsers[s]; !ok {
+		return "", fmt.Errorf("unknown format %q", s)
+	}
+	return s, nil
+}
+
+// detectFormat guesses the format from the start of the data.
+func detectFormat(start []byte) string {
+	start = bytes.TrimLeft(start, " \t\r\n\ufeff")
+	switch {
+	case bytes.HasPrefix(start, []byte("{")):
+		return "json"
+	case bytes.HasPrefix(start, []byte("roa-set")), bytes.Contains(start, []byte("source-as")):
+		return "openbgpd"
+	default:
+		return "csv"
+	}
+}
+
+// decodeFormat parses r in format, detecting it if format is empty.
+func decodeFormat(r io.Reader, format string, set *vrpSet, meta *metadata) error {
+	if format == "" {
+		br := bufio.NewReader(r)
+		start, _ := br.Peek(512)
+		format = detectFormat(start)
+		r = br
+	}
+	return parsers[format](r, set, meta)
+}
+
+// parseASN reads an ASN with or without an AS in front.
+func parseASN(s string) (uint32, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid asn %q", s)
+	}
+	return uint32(n), nil
+}
+
+// parseVRP builds a roa from text fields. An empty max length is the same as
+// the prefix length, and an empty expiry is never.
+func parseVRP(asn, prefix, maxLength, expires, ta string) (roa, error) {
+	a, err := parseASN(asn)
+	if err != nil {
+		return roa{}, err
+	}
+	p, err := netip.ParsePrefix(strings.TrimSpace(prefix))
+	if err != nil {
+		return roa{}, err
+	}
+	max := p.Bits()
+	if maxLength = strings.TrimSpace(maxLength); maxLength != "" {
+		if max, err = strconv.Atoi(maxLength); err != nil || max < 0 || max > 128 {
+			return roa{}, fmt.Errorf("invalid max length %q", maxLength)
+		}
+	}
+	var exp int64
+	if expires = strings.TrimSpace(expires); expires != "" {
+		if exp, err = strconv.ParseInt(expires, 10, 64); err != nil || exp < 0 {
+			return roa{}, fmt.Errorf("invalid expires %q", expires)
+		}
+	}
+	return roa{Prefix: p, MaxMask: uint8(max), ASN: a, Expires: exp, TAs: trustAnchors.bit(ta)}, nil
+}
+
+// decodeCSV reads CSV with a header naming the ASN, prefix, max length,
+// expires and trust anchor columns, such as
+// "ASN,IP Prefix,Max Length,Trust Anchor,Expires".
+// Without a header the columns are taken to be ASN, prefix and max length.
+func decodeCSV(r io.Reader, set *vrpSet, _ *metadata) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+
+	cols := [5]int{0, 1, 2, -1, -1}
+	for line := 0; ; line++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line == 0 {
+			if header, ok := csvHeader(rec); ok {
+				cols = header
+				continue
+			}
+		}
+		if cols[0] >= len(rec) || cols[1] >= len(rec) {
+			log.Printf("skipping short csv line %d: %q\n", line+1, rec)
+			continue
+		}
+		field := func(i int) string {
+			if i >= 0 && i < len(rec) {
+				return rec[i]
+			}
+			return ""
+		}
+		v, err := parseVRP(rec[cols[0]], rec[cols[1]], field(cols[2]), field(cols[3]), field(cols[4]))
+		if err != nil {
+			log.Printf("skipping csv line %d: %v\n", line+1, err)
+			continue
+		}
+		set.add(v)
+	}
+}
+
+// csvHeader returns the ASN, prefix, max length, expires and trust anchor
+// columns if rec is a header. Missing optional columns are -1.
+func csvHeader(rec []string) ([5]int, bool) {
+	cols := [5]int{-1, -1, -1, -1, -1}
+	for i, name := range rec {
+		name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+		switch name {
+		case "asn", "as", "origin", "origin as":
+			cols[0] = i
+		case "ip prefix", "prefix", "ip_prefix":
+			cols[1] = i
+		case "max length", "maxlength", "max_length", "maxlen":
+			cols[2] = i
+		case "expires":
+			cols[3] = i
+		case "trust anchor", "ta":
+			cols[4] = i
+		}
+	}
+	return cols, cols[0] >= 0 && cols[1] >= 0
+}
+
+// decodeRoaSet reads an OpenBGPD roa-set, either the whole block or just its
+// lines, e.g.
+//
+//	roa-set {
+//		192.0.2.0/24 maxlen 24 source-as 64496 expires 1700000000
+//	}
+func decodeRoaSet(r io.Reader, set *vrpSet, _ *metadata) error {
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		// Skip the block itself.
+		for len(fields) > 0 && (fields[0] == "roa-set" || fields[0] == "{" || fields[0] == "}") {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && fields[len(fields)-1] == "}" {
+			fields = fields[:len(fields)-1]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		prefix, max, asn, expires := fields[0], "", "", ""
+		for i := 1; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "maxlen":
+				max = fields[i+1]
+			case "source-as":
+				asn = fields[i+1]
+			case "expires":
+				expires = fields[i+1]
+			}
+		}
+		v, err := parseVRP(asn, prefix, max, expires, "")
+		if err != nil {
+			log.Printf("skipping roa-set line %d: %v\n", line, err)
+			continue
+		}
+		set.add(v)
+	}
+	return sc.Err()
+}
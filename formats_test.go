@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeFormat(t *testing.T) {
+	a := roa{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	b := roa{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 64497}
+	expiring := func(r roa) roa {
+		r.Expires = 1700000000
+		return r
+	}
+	from := func(r roa, ta string) roa {
+		r.TAs = trustAnchors.bit(ta)
+		return r
+	}
+
+	tests := []struct {
+		desc    string
+		format  string
+		data    string
+		want    []roa
+		wantErr bool
+	}{
+		{
+			desc: "json",
+			data: `{"roas": [{"asn": "AS64496", "prefix": "192.0.2.0/24", "maxLength": 24}]}`,
+			want: []roa{a},
+		},
+		{
+			desc: "routinator csv",
+			data: "ASN,IP Prefix,Max Length,Trust Anchor\nAS64496,192.0.2.0/24,24,ripe\nAS64497,2001:db8::/32,48,arin\n",
+			want: []roa{from(a, "ripe"), from(b, "arin")},
+		},
+		{
+			desc: "ripe csv",
+			data: "\"ASN\",\"IP Prefix\",\"Max Length\",\"Trust Anchor\"\n\"AS64496\",\"192.0.2.0/24\",\"24\",\"RIPE NCC RPKI Root\"\n",
+			want: []roa{from(a, "RIPE NCC RPKI Root")},
+		},
+		{
+			desc: "rpki-client csv with expires",
+			data: "ASN,IP Prefix,Max Length,Trust Anchor,Expires\nAS64497,2001:db8::/32,48,ripe,1700000000\n",
+			want: []roa{from(expiring(b), "ripe")},
+		},
+		{
+			desc: "csv with columns moved and no max length",
+			data: "Prefix,Origin AS\n192.0.2.0/24,64496\n",
+			want: []roa{a},
+		},
+		{
+			desc:   "csv without header",
+			format: "csv",
+			data:   "64496,192.0.2.0/24,24\nbad,line\n64497,2001:db8::/32,48\n",
+			want:   []roa{a, b},
+		},
+		{
+			desc: "roa-set block",
+			data: "# generated\nroa-set {\n\t192.0.2.0/24 source-as 64496 expires 1700000000\n\t2001:db8::/32 maxlen 48 source-as 64497\n}\n",
+			want: []roa{expiring(a), b},
+		},
+		{
+			desc:   "roa-set lines",
+			format: "openbgpd",
+			data:   "2001:db8::/32 maxlen 48 source-as 64497\n192.0.2.0/24 maxlen 24 source-as 64496 }\n",
+			want:   []roa{a, b},
+		},
+		{
+			desc:    "bad json",
+			format:  "json",
+			data:    "ASN,IP Prefix\n",
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		var set vrpSet
+		err := decodeFormat(strings.NewReader(v.data), v.format, &set, nil)
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+		}
+		if err != nil {
+			continue
+		}
+		set.normalize()
+		if got := set.roas(); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("Error on %s. Got %v, Want %v", v.desc, got, v.want)
+		}
+	}
+}
+
+// TestDecodeFixtures checks format detection on real exports.
+func TestDecodeFixtures(t *testing.T) {
+	cloudflare := roa{Prefix: netip.MustParsePrefix("1.0.0.0/24"), MaxMask: 24, ASN: 13335}
+	ripe := roa{Prefix: netip.MustParsePrefix("2001:7fb:fd02::/48"), MaxMask: 48, ASN: 196615}
+	from := func(r roa, ta string) roa {
+		r.TAs = trustAnchors.bit(ta)
+		return r
+	}
+	for _, tc := range []struct {
+		file string
+		want []roa
+	}{
+		{"data/routinator.csv", []roa{
+			from(cloudflare, "apnic"),
+			from(roa{Prefix: netip.MustParsePrefix("1.0.4.0/22"), MaxMask: 24, ASN: 38803}, "apnic"),
+			from(ripe, "ripe"),
+		}},
+		{"data/ripe-validator.csv", []roa{cloudflare, ripe}},
+	} {
+		f, err := os.Open(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var set vrpSet
+		err = decodeFormat(f, "", &set, nil)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+			continue
+		}
+		set.normalize()
+		if got := set.roas(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: Got %v, Want %v", tc.file, got, tc.want)
+		}
+	}
+}
+
+func TestParseASN(t *testing.T) {
+	for _, tc := range []struct {
+		text    string
+		want    uint32
+		wantErr bool
+	}{
+		{text: "AS123", want: 123},
+		{text: "as123", want: 123},
+		{text: "123", want: 123},
+		{text: "5", want: 5},
+		{text: "AS4294967295", want: 4294967295},
+		{text: "AS4294967296", wantErr: true},
+		{text: "AS", wantErr: true},
+		{text: "", wantErr: true},
+		{text: "word", wantErr: true},
+	} {
+		got, err := parseASN(tc.text)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("%q: Got %d, %v, Want %d, error %t", tc.text, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for in, want := range map[string]string{
+		"":               "",
+		"auto":           "",
+		"JSON":           "json",
+		"routinator-csv": "csv",
+		"roa-set":        "openbgpd",
+	} {
+		if got, err := parseFormat(in); err != nil || got != want {
+			t.Errorf("parseFormat(%q) = %q, %v, Want %q", in, got, err, want)
+		}
+	}
+	if _, err := parseFormat("xml"); err == nil {
+		t.Error("Wanted an error parsing xml, but none received")
+	}
+}
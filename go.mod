@@ -4,6 +4,7 @@ go 1.25rc1
 
 require (
 	github.com/google/go-cmp v0.7.0
+	github.com/klauspost/compress v1.18.0
 	gopkg.in/ini.v1 v1.67.0
 )
 
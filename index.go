@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// vrpIndex is a patricia trie per address family over a vrpSet. Each node
+// holds the VRPs for its prefix as indexes in to the set. Lookups only walk
+// one path through the trie, so take at most one step per prefix bit.
+type vrpIndex struct {
+	vrps vrpSet
+	v4   *trieNode
+	v6   *trieNode
+}
+
+type trieNode struct {
+	key   trieKey
+	child [2]*trieNode
+	// Nodes only created to join two others have no VRPs.
+	vrps []int32
+}
+
+// trieKey is a prefix of either family. IPv4 addresses sit in the top bits
+// of hi.
+type trieKey struct {
+	hi, lo uint64
+	bits   uint8
+}
+
+// newVRPIndex builds an index over vrps, which must not change afterwards.
+func newVRPIndex(vrps vrpSet) *vrpIndex {
+	x := &vrpIndex{vrps: vrps}
+	for i, v := range vrps.v4 {
+		x.v4 = insertNode(x.v4, key4(v.addr, v.bits), int32(i))
+	}
+	for i, v := range vrps.v6 {
+		x.v6 = insertNode(x.v6, key6(v.addr, v.bits), int32(i))
+	}
+	return x
+}
+
+func key4(addr [4]byte, bits uint8) trieKey {
+	return trieKey{hi: uint64(binary.BigEndian.Uint32(addr[:])) << 32, bits: bits}
+}
+
+func key6(addr [16]byte, bits uint8) trieKey {
+	return trieKey{
+		hi:   binary.BigEndian.Uint64(addr[:8]),
+		lo:   binary.BigEndian.Uint64(addr[8:]),
+		bits: bits,
+	}
+}
+
+// bit returns bit i of the key, counting from the most significant.
+func (k trieKey) bit(i uint8) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+// common returns the number of leading bits a and b share, up to the
+// shorter of the two prefix lengths.
+func common(a, b trieKey) uint8 {
+	n := uint8(bits.LeadingZeros64(a.hi ^ b.hi))
+	if n == 64 {
+		n += uint8(bits.LeadingZeros64(a.lo ^ b.lo))
+	}
+	return min(n, a.bits, b.bits)
+}
+
+// contains reports whether o is the same as or more specific than k.
+func (k trieKey) contains(o trieKey) bool {
+	return k.bits <= o.bits && common(k, o) == k.bits
+}
+
+// masked returns the key cut down to bits.
+func (k trieKey) masked(bits uint8) trieKey {
+	switch {
+	case bits == 0:
+		return trieKey{}
+	case bits < 64:
+		return trieKey{hi: k.hi &^ (1<<(64-bits) - 1), bits: bits}
+	case bits == 64:
+		return trieKey{hi: k.hi, bits: bits}
+	default:
+		return trieKey{hi: k.hi, lo: k.lo &^ (1<<(128-bits) - 1), bits: bits}
+	}
+}
+
+// insertNode adds the VRP at idx under key, returning the new root.
+func insertNode(root *trieNode, key trieKey, idx int32) *trieNode {
+	next := &root
+	for {
+		n := *next
+		if n == nil {
+			*next = &trieNode{key: key, vrps: []int32{idx}}
+			return root
+		}
+		c := common(n.key, key)
+		switch {
+		case c == n.key.bits && c == key.bits:
+			n.vrps = append(n.vrps, idx)
+			return root
+		case c == n.key.bits:
+			// key is below n.
+			next = &n.child[key.bit(c)]
+			continue
+		case c == key.bits:
+			// n is below key.
+			m := &trieNode{key: key, vrps: []int32{idx}}
+			m.child[n.key.bit(c)] = n
+			*next = m
+		default:
+			// They split at bit c, so join them with a new node.
+			m := &trieNode{key: key.masked(c)}
+			m.child[key.bit(c)] = &trieNode{key: key, vrps: []int32{idx}}
+			m.child[n.key.bit(c)] = n
+			*next = m
+		}
+		return root
+	}
+}
+
+// lookupKey returns the root and key for p, and whether p is IPv4. Invalid
+// prefixes get no root.
+func (x *vrpIndex) lookupKey(p netip.Prefix) (*trieNode, trieKey, bool) {
+	if !p.IsValid() {
+		return nil, trieKey{}, false
+	}
+	p = p.Masked()
+	if p.Addr().Is4() {
+		return x.v4, key4(p.Addr().As4(), uint8(p.Bits())), true
+	}
+	return x.v6, key6(p.Addr().As16(), uint8(p.Bits())), false
+}
+
+// roas appends the VRPs held by n.
+func (x *vrpIndex) roas(n *trieNode, is4 bool, roas []roa) []roa {
+	for _, i := range n.vrps {
+		if is4 {
+			roas = append(roas, x.vrps.v4[i].roa())
+		} else {
+			roas = append(roas, x.vrps.v6[i].roa())
+		}
+	}
+	return roas
+}
+
+// exact returns the VRPs for exactly p.
+func (x *vrpIndex) exact(p netip.Prefix) []roa {
+	n, key, is4 := x.lookupKey(p)
+	for n != nil && n.key.contains(key) {
+		if n.key == key {
+			return x.roas(n, is4, nil)
+		}
+		n = n.child[key.bit(n.key.bits)]
+	}
+	return nil
+}
+
+// covering returns the VRPs for p and every less specific prefix of it,
+// least specific first. These are the VRPs that decide whether a route for
+// p is valid.
+func (x *vrpIndex) covering(p netip.Prefix) []roa {
+	var roas []roa
+	n, key, is4 := x.lookupKey(p)
+	for n != nil && n.key.contains(key) {
+		roas = x.roas(n, is4, roas)
+		if n.key.bits == key.bits {
+			break
+		}
+		n = n.child[key.bit(n.key.bits)]
+	}
+	return roas
+}
+
+// covered returns the VRPs for p and every more specific prefix within it.
+func (x *vrpIndex) covered(p netip.Prefix) []roa {
+	n, key, is4 := x.lookupKey(p)
+	for n != nil {
+		if key.contains(n.key) {
+			return x.subtree(n, is4, nil)
+		}
+		if !n.key.contains(key) {
+			break
+		}
+		n = n.child[key.bit(n.key.bits)]
+	}
+	return nil
+}
+
+// subtree returns the VRPs at n and all below it, in address order.
+func (x *vrpIndex) subtree(n *trieNode, is4 bool, roas []roa) []roa {
+	if n == nil {
+		return roas
+	}
+	roas = x.roas(n, is4, roas)
+	roas = x.subtree(n.child[0], is4, roas)
+	return x.subtree(n.child[1], is4, roas)
+}
+
+// lookup serves the VRPs matching a prefix from the current snapshot, e.g.
+// /vrps?prefix=192.0.2.0/24&match=covering. match can be exact, covering or
+// covered, and defaults to covering.
+func (s *CacheServer) lookup(w http.ResponseWriter, r *http.Request) {
+	p, err := netip.ParsePrefix(r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid prefix: %v", err), http.StatusBadRequest)
+		return
+	}
+	snap := s.current.Load()
+
+	var roas []roa
+	switch match := r.URL.Query().Get("match"); match {
+	case "", "covering":
+		roas = snap.index().covering(p)
+	case "covered":
+		roas = snap.index().covered(p)
+	case "exact":
+		roas = snap.index().exact(p)
+	default:
+		http.Error(w, fmt.Sprintf("unknown match %q", match), http.StatusBadRequest)
+		return
+	}
+
+	out := struct {
+		Serial uint32    `json:"serial"`
+		ROAs   []jsonroa `json:"roas"`
+	}{
+		Serial: snap.serial,
+		ROAs:   make([]jsonroa, 0, len(roas)),
+	}
+	for _, v := range roas {
+		out.ROAs = append(out.ROAs, jsonroa{
+			Prefix:  v.Prefix.String(),
+			Mask:    v.MaxMask,
+			ASN:     jsonASN(v.ASN),
+			Expires: v.Expires,
+			TA:      strings.Join(trustAnchors.lookup(v.TAs), ","),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("unable to write lookup response: %v\n", err)
+	}
+}
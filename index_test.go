@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// randomROAs returns ROAs bunched in to a few ranges, so there are plenty
+// of covering prefixes.
+func randomROAs(r *rand.Rand, n int) []roa {
+	var roas []roa
+	for range n {
+		if r.IntN(2) == 0 {
+			bits := 8 + r.IntN(25)
+			addr := netip.AddrFrom4([4]byte{10, byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256))})
+			roas = append(roas, roa{Prefix: netip.PrefixFrom(addr, bits).Masked(), MaxMask: 32, ASN: uint32(r.IntN(10))})
+			continue
+		}
+		bits := 16 + r.IntN(113)
+		addr := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(r.IntN(4)), 15: byte(r.IntN(256))})
+		roas = append(roas, roa{Prefix: netip.PrefixFrom(addr, bits).Masked(), MaxMask: 128, ASN: uint32(r.IntN(10))})
+	}
+	return roas
+}
+
+func TestVRPIndex(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+	set := newVRPSet(randomROAs(r, 2000))
+	idx := newVRPIndex(set)
+	all := set.roas()
+
+	// Compare against a scan of every VRP, for prefixes both in the set and
+	// made up.
+	queries := []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.0/24"),
+	}
+	for _, v := range randomROAs(r, 200) {
+		queries = append(queries, v.Prefix)
+	}
+	for _, v := range all[:200] {
+		queries = append(queries, v.Prefix)
+	}
+
+	for _, q := range queries {
+		var exact, covering, covered []roa
+		for _, v := range all {
+			if v.Prefix.Addr().Is4() != q.Addr().Is4() {
+				continue
+			}
+			if v.Prefix == q {
+				exact = append(exact, v)
+			}
+			if v.Prefix.Bits() <= q.Bits() && v.Prefix.Contains(q.Addr()) {
+				covering = append(covering, v)
+			}
+			if q.Bits() <= v.Prefix.Bits() && q.Contains(v.Prefix.Addr()) {
+				covered = append(covered, v)
+			}
+		}
+		for _, v := range []struct {
+			match string
+			got   []roa
+			want  []roa
+		}{
+			{"exact", idx.exact(q), exact},
+			{"covering", idx.covering(q), covering},
+			{"covered", idx.covered(q), covered},
+		} {
+			if len(v.got) != len(v.want) || !slices.Equal(newVRPSet(v.got).roas(), v.want) {
+				t.Errorf("Error on %s %v. Got %d VRPs, Want %d", v.match, q, len(v.got), len(v.want))
+			}
+		}
+	}
+}
+
+func TestLookupHandler(t *testing.T) {
+	s := &CacheServer{}
+	s.current.Store(newSnapshot(newVRPSet([]roa{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 1},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 2},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), MaxMask: 16, ASN: 3},
+	}), 7, 1, serialDiff{}))
+
+	tests := []struct {
+		desc     string
+		query    string
+		wantCode int
+		wantASNs []jsonASN
+	}{
+		{
+			desc:     "covering by default",
+			query:    "prefix=10.0.1.0/24",
+			wantCode: http.StatusOK,
+			wantASNs: []jsonASN{1, 2},
+		},
+		{
+			desc:     "covered",
+			query:    "prefix=10.0.0.0/8&match=covered",
+			wantCode: http.StatusOK,
+			wantASNs: []jsonASN{1, 2, 3},
+		},
+		{
+			desc:     "exact",
+			query:    "prefix=10.0.0.0/16&match=exact",
+			wantCode: http.StatusOK,
+			wantASNs: []jsonASN{1},
+		},
+		{
+			desc:     "no match",
+			query:    "prefix=192.0.2.0/24",
+			wantCode: http.StatusOK,
+			wantASNs: []jsonASN{},
+		},
+		{
+			desc:     "bad prefix",
+			query:    "prefix=10.0.0.0",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			desc:     "bad match",
+			query:    "prefix=10.0.0.0/8&match=all",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, v := range tests {
+		rec := httptest.NewRecorder()
+		s.lookup(rec, httptest.NewRequest("GET", "/vrps?"+v.query, nil))
+		if rec.Code != v.wantCode {
+			t.Errorf("Error on %s. Got status %d, Want %d", v.desc, rec.Code, v.wantCode)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var got struct {
+			Serial uint32    `json:"serial"`
+			ROAs   []jsonroa `json:"roas"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("Error on %s. Unable to decode response: %v", v.desc, err)
+		}
+		asns := []jsonASN{}
+		for _, r := range got.ROAs {
+			asns = append(asns, r.ASN)
+		}
+		if got.Serial != 7 || !slices.Equal(asns, v.wantASNs) {
+			t.Errorf("Error on %s. Got serial %d ASNs %v, Want serial 7 ASNs %v", v.desc, got.Serial, asns, v.wantASNs)
+		}
+	}
+}
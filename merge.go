@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// mergePolicy decides which VRPs from several sources are published. The
+// zero value is a union.
+type mergePolicy struct {
+	name string
+	// quorum is how many sources must have a VRP, unless all must.
+	quorum int
+	all    bool
+	// Only one source at a time is served with failover.
+	failover *failover
+}
+
+var unionPolicy = mergePolicy{name: "union", quorum: 1}
+
+// parseMergePolicy reads union, intersection, quorum:K or failover.
+func parseMergePolicy(s string) (mergePolicy, error) {
+	switch s = strings.ToLower(strings.TrimSpace(s)); {
+	case s == "" || s == "union":
+		return unionPolicy, nil
+	case s == "intersection":
+		return mergePolicy{name: s, all: true}, nil
+	case s == "failover":
+		return mergePolicy{name: s, quorum: 1, failover: newFailover()}, nil
+	case strings.HasPrefix(s, "quorum:"):
+		k, err := strconv.Atoi(strings.TrimPrefix(s, "quorum:"))
+		if err != nil || k < 1 {
+			return mergePolicy{}, fmt.Errorf("quorum needs to be at least 1: %q", s)
+		}
+		return mergePolicy{name: s, quorum: k}, nil
+	default:
+		return mergePolicy{}, fmt.Errorf("unknown merge policy %q, use union, intersection, quorum:K or failover", s)
+	}
+}
+
+// check returns an error if the policy can never be met with this many
+// sources configured.
+func (p mergePolicy) check(sources int) error {
+	if sources > 0 && p.needed(sources) > sources {
+		return fmt.Errorf("merge policy %s needs more than the %d sources configured", p.name, sources)
+	}
+	return nil
+}
+
+// needed returns how many sources must have a VRP, out of total configured.
+func (p mergePolicy) needed(total int) int {
+	if p.all {
+		return total
+	}
+	return max(p.quorum, 1)
+}
+
+// apply merges the normalized sets from each source that was fetched, out
+// of total sources configured. The sets aren't changed. If fewer sources
+// were fetched than a VRP needs, nothing could pass, so it's an error rather
+// than an empty set and the previous VRPs are kept.
+func (p mergePolicy) apply(sets []vrpSet, total int) (vrpSet, error) {
+	k := p.needed(total)
+	if len(sets) < k {
+		return vrpSet{}, fmt.Errorf("only %d of %d sources were fetched, and %s needs %d", len(sets), total, p.name, k)
+	}
+
+	// A single source is already normalized and can be used as is.
+	if len(sets) == 1 && k <= 1 {
+		return sets[0], nil
+	}
+	var v4, v6 int
+	for _, set := range sets {
+		v4 += len(set.v4)
+		v6 += len(set.v6)
+	}
+	var roas vrpSet
+	roas.v4 = make([]vrp4, 0, v4)
+	roas.v6 = make([]vrp6, 0, v6)
+	for _, set := range sets {
+		roas.merge(set)
+	}
+	if k <= 1 {
+		return GetSetOfValidatedROAs(roas), nil
+	}
+
+	// Each source has no duplicates, so after sorting the length of each run
+	// is how many sources have that VRP.
+	roas.sort()
+	roas.v4 = keepRuns(roas.v4, k, compareVRP4)
+	roas.v6 = keepRuns(roas.v6, k, compareVRP6)
+	return roas, nil
+}
+
+// keepRuns keeps every VRP repeated at least k times in a row, merging each
+// run in to one.
+func keepRuns[T packedVRP[T]](s []T, k int, compare func(a, b T) int) []T {
+	out := s[:0]
+	for i := 0; i < len(s); {
+		v := s[i]
+		j := i + 1
+		for ; j < len(s) && compare(s[j], s[i]) == 0; j++ {
+			v = v.merged(s[j])
+		}
+		if j-i >= k {
+			out = append(out, v)
+		}
+		i = j
+	}
+	return slices.Clip(out)
+}
+
+// agreement returns how many VRPs in set weren't published, and how many
+// published VRPs set doesn't have.
+func agreement(set, published vrpSet) (rejected, missing int) {
+	diffSorted(set.v4, published.v4, compareVRP4, func(vrp4) { rejected++ }, func(vrp4) { missing++ })
+	diffSorted(set.v6, published.v6, compareVRP6, func(vrp6) { rejected++ }, func(vrp6) { missing++ })
+	return rejected, missing
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestMergePolicy(t *testing.T) {
+	a := roa{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxMask: 24, ASN: 1}
+	b := roa{Prefix: netip.MustParsePrefix("198.51.100.0/24"), MaxMask: 24, ASN: 2}
+	c := roa{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 3}
+	sets := []vrpSet{
+		newVRPSet([]roa{a, b, c}),
+		newVRPSet([]roa{a, b}),
+		newVRPSet([]roa{a}),
+	}
+
+	tests := []struct {
+		policy  string
+		sets    []vrpSet
+		total   int
+		want    []roa
+		wantErr bool
+		// failed is when too few sources were fetched for the policy.
+		failed bool
+	}{
+		{policy: "union", sets: sets, total: 3, want: []roa{a, b, c}},
+		{policy: "", sets: sets, total: 3, want: []roa{a, b, c}},
+		{policy: "intersection", sets: sets, total: 3, want: []roa{a}},
+		{policy: "quorum:2", sets: sets, total: 3, want: []roa{a, b}},
+		{policy: "quorum:3", sets: sets, total: 3, want: []roa{a}},
+		{policy: "quorum:4", sets: sets, total: 3, failed: true},
+		// A failed source still counts for intersection.
+		{policy: "intersection", sets: sets[:2], total: 3, failed: true},
+		{policy: "intersection", sets: sets[:1], total: 1, want: []roa{a, b, c}},
+		{policy: "quorum:2", sets: sets[:2], total: 3, want: []roa{a, b}},
+		{policy: "quorum:2", sets: sets[:1], total: 3, failed: true},
+		{policy: "union", sets: sets[:1], total: 3, want: []roa{a, b, c}},
+		{policy: "quorum:0", wantErr: true},
+		{policy: "majority", wantErr: true},
+	}
+	for _, v := range tests {
+		p, err := parseMergePolicy(v.policy)
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %q. Wanted an error, but none received", v.policy)
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %q. No error expected, but error received: %v", v.policy, err)
+		}
+		if err != nil {
+			continue
+		}
+		before := sets[0].len()
+		got, err := p.apply(v.sets, v.total)
+		if (err != nil) != v.failed {
+			t.Errorf("Error on %q with %d of %d sources. Got error %v, Want failure %t", v.policy, len(v.sets), v.total, err, v.failed)
+			continue
+		}
+		if !slices.Equal(got.roas(), v.want) {
+			t.Errorf("Error on %q with %d of %d sources. Got %v, Want %v", v.policy, len(v.sets), v.total, got.roas(), v.want)
+		}
+		if sets[0].len() != before {
+			t.Errorf("Error on %q. Source set was changed", v.policy)
+		}
+	}
+
+	for _, v := range []struct {
+		policy  string
+		sources int
+		wantErr bool
+	}{
+		{policy: "quorum:3", sources: 3},
+		{policy: "quorum:4", sources: 3, wantErr: true},
+		{policy: "intersection", sources: 1},
+		{policy: "quorum:2", sources: 0},
+	} {
+		p, _ := parseMergePolicy(v.policy)
+		if err := p.check(v.sources); (err != nil) != v.wantErr {
+			t.Errorf("Error on %q with %d sources. Got %v, Want error %t", v.policy, v.sources, err, v.wantErr)
+		}
+	}
+
+	rejected, missing := agreement(sets[1], newVRPSet([]roa{a, c}))
+	if rejected != 1 || missing != 1 {
+		t.Errorf("Got %d rejected and %d missing, Want 1 and 1", rejected, missing)
+	}
+}
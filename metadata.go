@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// metadata is what a validator says about the feed it wrote. rpki-client has
+// buildtime and counters, Routinator has generated.
+type metadata struct {
+	// generated is when the feed was built, zero if unknown.
+	generated   time.Time
+	failedROAs  int
+	invalidROAs int
+}
+
+// decodeMetadata reads the metadata object of a JSON feed. Fields vary
+// between validators and versions, so anything unexpected is ignored.
+func decodeMetadata(dec *json.Decoder, meta *metadata) error {
+	var fields map[string]any
+	if err := dec.Decode(&fields); err != nil {
+		return err
+	}
+	for _, key := range []string{"buildtime", "generatedTime"} {
+		if s, ok := fields[key].(string); ok {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				log.Printf("ignoring metadata %s: %v\n", key, err)
+				continue
+			}
+			meta.generated = t
+			break
+		}
+	}
+	if n, ok := fields["generated"].(float64); ok && meta.generated.IsZero() {
+		meta.generated = time.Unix(int64(n), 0)
+	}
+	if n, ok := fields["failedroas"].(float64); ok {
+		meta.failedROAs = int(n)
+	}
+	if n, ok := fields["invalidroas"].(float64); ok {
+		meta.invalidROAs = int(n)
+	}
+	return nil
+}
+
+// combine adds the metadata of another file in the same source. The oldest
+// file decides how old the source is.
+func (m metadata) combine(o metadata) metadata {
+	if m.generated.IsZero() || (!o.generated.IsZero() && o.generated.Before(m.generated)) {
+		m.generated = o.generated
+	}
+	m.failedROAs += o.failedROAs
+	m.invalidROAs += o.invalidROAs
+	return m
+}
+
+// checkAge returns an error if the feed was generated more than maxAge ago.
+// Feeds that don't say when they were generated are never stale.
+func (m metadata) checkAge(maxAge time.Duration, now time.Time) error {
+	if maxAge == 0 || m.generated.IsZero() {
+		return nil
+	}
+	if age := now.Sub(m.generated); age > maxAge {
+		return fmt.Errorf("feed was generated %v ago, older than max_age of %v", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecodeMetadata(t *testing.T) {
+	tests := []struct {
+		file string
+		want metadata
+	}{
+		{
+			file: "data/int.json",
+			want: metadata{generated: time.Date(2021, 10, 21, 23, 33, 14, 0, time.UTC), failedROAs: 4, invalidROAs: 1},
+		},
+		{
+			file: "data/string.json",
+			want: metadata{generated: time.Date(2021, 10, 22, 1, 19, 3, 0, time.UTC)},
+		},
+	}
+	for _, v := range tests {
+		f, err := os.Open(v.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := decodeFeed(f, v.file, "", defaultMaxSize)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Error decoding %s: %v", v.file, err)
+		}
+		if !got.generated.Equal(v.want.generated) || got.failedROAs != v.want.failedROAs || got.invalidROAs != v.want.invalidROAs {
+			t.Errorf("Error on %s. Got %+v, Want %+v", v.file, got, v.want)
+		}
+	}
+}
+
+func TestStaleSource(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old.json")
+	writeFile(t, old, `{"metadata": {"buildtime": "2021-10-21T23:33:14Z"}, "roas": [{"asn": 64496, "prefix": "192.0.2.0/24", "maxLength": 24}]}`)
+
+	src := newSources([]sourceConfig{{url: "file://" + old, maxAge: time.Hour}})[0]
+	if _, _, err := src.fetch(); err == nil {
+		t.Error("Wanted a stale source to be excluded, but no error received")
+	}
+	if st := src.lastStatus(); st.stale == nil {
+		t.Error("Wanted the source to be marked stale")
+	}
+
+	src = newSources([]sourceConfig{{url: "file://" + old, maxAge: time.Hour, alertStale: true}})[0]
+	vrps, _, err := src.fetch()
+	if err != nil {
+		t.Fatalf("Wanted a stale source to only be alerted on, but error received: %v", err)
+	}
+	if vrps.len() != 1 || src.lastStatus().stale == nil {
+		t.Errorf("Got %d VRPs and stale %v, Want 1 VRP and stale", vrps.len(), src.lastStatus().stale)
+	}
+
+	// Without a generated time, or a max age, nothing is stale.
+	fresh := filepath.Join(dir, "fresh.json")
+	writeFile(t, fresh, vrpJSON("192.0.2.0/24"))
+	src = newSources([]sourceConfig{{url: "file://" + fresh, maxAge: time.Hour}})[0]
+	if _, _, err := src.fetch(); err != nil {
+		t.Errorf("No error expected, but error received: %v", err)
+	}
+	src = newSources([]sourceConfig{{url: "file://" + old}})[0]
+	if _, _, err := src.fetch(); err != nil {
+		t.Errorf("No error expected, but error received: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// listenHTTP binds the status and metrics HTTP server. Like the RTR
+// listeners, this is done before dropping privileges.
+func (s *CacheServer) listenHTTP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen for http on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", s.metrics)
+	mux.HandleFunc("GET /vrps", s.lookup)
+	mux.HandleFunc("GET /events", s.eventsHandler)
+	mux.HandleFunc("GET /slurm", s.slurmHandler)
+	mux.HandleFunc("GET /quarantine", s.quarantineHandler)
+
+	go func() {
+		log.Printf("HTTP server started on %s\n", l.Addr().String())
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("HTTP server on %s stopped: %v\n", addr, err)
+		}
+	}()
+	return nil
+}
+
+// metrics writes out the current state in the Prometheus text format.
+func (s *CacheServer) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	snap := s.current.Load()
+	// Taken before the lock, as publishing holds this while taking the lock.
+	var quarantined int
+	if s.quarantineStatus() != nil {
+		quarantined = 1
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	v4, v6 := len(snap.vrps.v4), len(snap.vrps.v6)
+	writeMetric(w, "rpkirtr_serial", "gauge", "Current serial number.")
+	fmt.Fprintf(w, "rpkirtr_serial %d\n", snap.serial)
+	writeMetric(w, "rpkirtr_vrps", "gauge", "Number of VRPs being served.")
+	fmt.Fprintf(w, "rpkirtr_vrps{family=\"ipv4\"} %d\n", v4)
+	fmt.Fprintf(w, "rpkirtr_vrps{family=\"ipv6\"} %d\n", v6)
+	writeMetric(w, "rpkirtr_vrps_aggregated", "gauge", "VRPs removed by aggregation.")
+	fmt.Fprintf(w, "rpkirtr_vrps_aggregated %d\n", snap.aggregated)
+
+	if filters := s.filters.status(); len(filters) > 0 {
+		writeMetric(w, "rpkirtr_vrps_filtered", "gauge", "VRPs removed or changed by each filter in the last update.")
+		for _, f := range filters {
+			fmt.Fprintf(w, "rpkirtr_vrps_filtered{rule=%s} %d\n", labelValue(f.rule), f.count)
+		}
+	}
+	if st := s.slurm.status(); st != nil {
+		writeMetric(w, "rpkirtr_slurm_vrps", "gauge", "VRPs filtered and asserted by SLURM in the last update.")
+		fmt.Fprintf(w, "rpkirtr_slurm_vrps{action=\"filtered\"} %d\n", st.filtered)
+		fmt.Fprintf(w, "rpkirtr_slurm_vrps{action=\"asserted\"} %d\n", st.asserted)
+		var failed int
+		if st.err != nil {
+			failed = 1
+		}
+		writeMetric(w, "rpkirtr_slurm_reload_failed", "gauge", "Whether the last change to the SLURM files failed to load.")
+		fmt.Fprintf(w, "rpkirtr_slurm_reload_failed %d\n", failed)
+	}
+
+	writeMetric(w, "rpkirtr_quarantined", "gauge", "Whether an update is held in quarantine.")
+	fmt.Fprintf(w, "rpkirtr_quarantined %d\n", quarantined)
+
+	writeMetric(w, "rpkirtr_source_up", "gauge", "Whether the last fetch of each source succeeded.")
+	statuses := make([]sourceStatus, len(s.sources))
+	for i, src := range s.sources {
+		statuses[i] = src.lastStatus()
+		var up int
+		if statuses[i].err == nil && !statuses[i].lastSuccess.IsZero() {
+			up = 1
+		}
+		fmt.Fprintf(w, "rpkirtr_source_up{source=%s} %d\n", labelValue(src.name), up)
+	}
+	if fo := s.merge.failover; fo != nil {
+		active, switches, _ := fo.status()
+		writeMetric(w, "rpkirtr_source_active", "gauge", "Whether each source is the one being served.")
+		for i, src := range s.sources {
+			var on int
+			if i == active {
+				on = 1
+			}
+			fmt.Fprintf(w, "rpkirtr_source_active{source=%s} %d\n", labelValue(src.name), on)
+		}
+		writeMetric(w, "rpkirtr_failover_switches_total", "counter", "Times the source being served has changed.")
+		fmt.Fprintf(w, "rpkirtr_failover_switches_total %d\n", switches)
+	}
+	writeMetric(w, "rpkirtr_source_vrps", "gauge", "VRPs in the last successful fetch of each source.")
+	for i, src := range s.sources {
+		fmt.Fprintf(w, "rpkirtr_source_vrps{source=%s} %d\n", labelValue(src.name), statuses[i].vrps)
+	}
+	writeMetric(w, "rpkirtr_source_rejected_vrps", "gauge", "VRPs from each source left out by the merge policy.")
+	for i, src := range s.sources {
+		fmt.Fprintf(w, "rpkirtr_source_rejected_vrps{source=%s} %d\n", labelValue(src.name), statuses[i].rejected)
+	}
+	writeMetric(w, "rpkirtr_source_missing_vrps", "gauge", "Published VRPs each source doesn't have.")
+	for i, src := range s.sources {
+		fmt.Fprintf(w, "rpkirtr_source_missing_vrps{source=%s} %d\n", labelValue(src.name), statuses[i].missing)
+	}
+	writeMetric(w, "rpkirtr_source_fetch_duration_seconds", "gauge", "How long the last fetch of each source took, including retries.")
+	for i, src := range s.sources {
+		fmt.Fprintf(w, "rpkirtr_source_fetch_duration_seconds{source=%s} %g\n", labelValue(src.name), statuses[i].duration.Seconds())
+	}
+	writeMetric(w, "rpkirtr_source_last_success_timestamp_seconds", "gauge", "When each source was last fetched successfully.")
+	for i, src := range s.sources {
+		if !statuses[i].lastSuccess.IsZero() {
+			fmt.Fprintf(w, "rpkirtr_source_last_success_timestamp_seconds{source=%s} %d\n", labelValue(src.name), statuses[i].lastSuccess.Unix())
+		}
+	}
+	writeMetric(w, "rpkirtr_source_stale", "gauge", "Whether each source's feed is older than max_age.")
+	for i, src := range s.sources {
+		var stale int
+		if statuses[i].stale != nil {
+			stale = 1
+		}
+		fmt.Fprintf(w, "rpkirtr_source_stale{source=%s} %d\n", labelValue(src.name), stale)
+	}
+	writeMetric(w, "rpkirtr_source_generated_timestamp_seconds", "gauge", "When each source's feed says it was generated.")
+	for i, src := range s.sources {
+		if g := statuses[i].meta.generated; !g.IsZero() {
+			fmt.Fprintf(w, "rpkirtr_source_generated_timestamp_seconds{source=%s} %d\n", labelValue(src.name), g.Unix())
+		}
+	}
+	writeMetric(w, "rpkirtr_source_failed_roas", "gauge", "ROAs each source's validator failed to process.")
+	for i, src := range s.sources {
+		fmt.Fprintf(w, "rpkirtr_source_failed_roas{source=%s} %d\n", labelValue(src.name), statuses[i].meta.failedROAs)
+	}
+	writeMetric(w, "rpkirtr_source_invalid_roas", "gauge", "ROAs each source's validator found invalid.")
+	for i, src := range s.sources {
+		fmt.Fprintf(w, "rpkirtr_source_invalid_roas{source=%s} %d\n", labelValue(src.name), statuses[i].meta.invalidROAs)
+	}
+	writeMetric(w, "rpkirtr_source_last_error_timestamp_seconds", "gauge", "When fetching each source last failed.")
+	for i, src := range s.sources {
+		if !statuses[i].lastError.IsZero() {
+			fmt.Fprintf(w, "rpkirtr_source_last_error_timestamp_seconds{source=%s} %d\n", labelValue(src.name), statuses[i].lastError.Unix())
+		}
+	}
+
+	writeMetric(w, "rpkirtr_listener_clients", "gauge", "Clients currently connected to each listener.")
+	for _, l := range s.listeners {
+		var connected int
+		for _, c := range s.clients {
+			if c.listener == l.label {
+				connected++
+			}
+		}
+		fmt.Fprintf(w, "rpkirtr_listener_clients{listener=%s} %d\n", labelValue(l.label), connected)
+	}
+	writeMetric(w, "rpkirtr_listener_accepted_total", "counter", "Clients accepted by each listener.")
+	for _, l := range s.listeners {
+		fmt.Fprintf(w, "rpkirtr_listener_accepted_total{listener=%s} %d\n", labelValue(l.label), atomic.LoadUint64(&l.accepted))
+	}
+
+	// Per client TCP health. Clients not yet sampled are skipped.
+	type sample struct {
+		labels string
+		stats  tcpStats
+	}
+	var samples []sample
+	for _, c := range s.clients {
+		stats := c.tcpStats()
+		if stats.sampled.IsZero() {
+			continue
+		}
+		samples = append(samples, sample{
+			labels: fmt.Sprintf("client=%s,listener=%s", labelValue(c.remote), labelValue(c.listener)),
+			stats:  stats,
+		})
+	}
+	writeMetric(w, "rpkirtr_client_rtt_seconds", "gauge", "Smoothed round trip time to each client.")
+	for _, v := range samples {
+		fmt.Fprintf(w, "rpkirtr_client_rtt_seconds{%s} %g\n", v.labels, v.stats.rtt.Seconds())
+	}
+	writeMetric(w, "rpkirtr_client_rtt_variance_seconds", "gauge", "Round trip time variance to each client.")
+	for _, v := range samples {
+		fmt.Fprintf(w, "rpkirtr_client_rtt_variance_seconds{%s} %g\n", v.labels, v.stats.rttVar.Seconds())
+	}
+	writeMetric(w, "rpkirtr_client_retransmits_total", "counter", "Segments retransmitted to each client.")
+	for _, v := range samples {
+		fmt.Fprintf(w, "rpkirtr_client_retransmits_total{%s} %d\n", v.labels, v.stats.retransmits)
+	}
+	writeMetric(w, "rpkirtr_client_send_queue_bytes", "gauge", "Bytes in the socket send queue not yet acknowledged by each client.")
+	for _, v := range samples {
+		fmt.Fprintf(w, "rpkirtr_client_send_queue_bytes{%s} %d\n", v.labels, v.stats.sendQueue)
+	}
+	writeMetric(w, "rpkirtr_client_cwnd_segments", "gauge", "Congestion window to each client.")
+	for _, v := range samples {
+		fmt.Fprintf(w, "rpkirtr_client_cwnd_segments{%s} %d\n", v.labels, v.stats.cwnd)
+	}
+}
+
+// labelEscaper escapes a label value for the Prometheus text format, which
+// only knows these three escapes.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns v quoted as a label value.
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// writeMetric writes the help and type lines for a metric.
+func writeMetric(w io.Writer, name, mtype, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+}
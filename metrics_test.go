@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	filters, err := parseFilters([]string{"bogons"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &CacheServer{
+		mutex:      &sync.RWMutex{},
+		filters:    filters,
+		quarantine: &quarantined{},
+		sources: newSources([]sourceConfig{
+			{name: `rir "a" \ b`, url: "https://example.com/a.json"},
+			{url: "https://example.net/b.json"},
+		}),
+		listeners: []*listener{{label: "rtr\nplain", accepted: 3}},
+	}
+	snap := newSnapshot(newVRPSet(makeROAs(10, 0)), 5, 1, serialDiff{})
+	snap.aggregated = 2
+	s.current.Store(snap)
+
+	generated := time.Unix(1700000000, 0)
+	s.sources[0].status = sourceStatus{
+		lastSuccess: time.Unix(1700000100, 0),
+		vrps:        10,
+		meta:        metadata{generated: generated, failedROAs: 4, invalidROAs: 7},
+		stale:       errors.New("too old"),
+	}
+	s.sources[1].status = sourceStatus{
+		lastError: time.Unix(1700000200, 0),
+		err:       errors.New("unreachable"),
+	}
+
+	rec := httptest.NewRecorder()
+	s.metrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"rpkirtr_serial 5",
+		`rpkirtr_vrps{family="ipv4"} 5`,
+		`rpkirtr_vrps{family="ipv6"} 5`,
+		"rpkirtr_vrps_aggregated 2",
+		`rpkirtr_vrps_filtered{rule="bogons"} 0`,
+		"rpkirtr_quarantined 1",
+		// Quotes and backslashes are escaped, everything else left alone.
+		`rpkirtr_source_up{source="rir \"a\" \\ b"} 1`,
+		`rpkirtr_source_up{source="https://example.net/b.json"} 0`,
+		`rpkirtr_source_vrps{source="rir \"a\" \\ b"} 10`,
+		`rpkirtr_source_last_success_timestamp_seconds{source="rir \"a\" \\ b"} 1700000100`,
+		`rpkirtr_source_last_error_timestamp_seconds{source="https://example.net/b.json"} 1700000200`,
+		// The metadata counters from the feed.
+		`rpkirtr_source_stale{source="rir \"a\" \\ b"} 1`,
+		`rpkirtr_source_stale{source="https://example.net/b.json"} 0`,
+		`rpkirtr_source_generated_timestamp_seconds{source="rir \"a\" \\ b"} 1700000000`,
+		`rpkirtr_source_failed_roas{source="rir \"a\" \\ b"} 4`,
+		`rpkirtr_source_invalid_roas{source="rir \"a\" \\ b"} 7`,
+		`rpkirtr_source_failed_roas{source="https://example.net/b.json"} 0`,
+		`rpkirtr_listener_accepted_total{listener="rtr\nplain"} 3`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("Metrics missing %s", want)
+		}
+	}
+	for _, unwanted := range []string{
+		"rpkirtr_slurm_vrps",
+		"rpkirtr_source_active",
+		`rpkirtr_source_generated_timestamp_seconds{source="https://example.net/b.json"}`,
+	} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("Metrics have %s, which shouldn't be there", unwanted)
+		}
+	}
+
+	// Every sample has its metric's HELP and TYPE before it.
+	typed := map[string]bool{}
+	for line := range strings.Lines(body) {
+		if name, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			typed[strings.Fields(name)[0]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, _, _ := strings.Cut(line, "{")
+		name, _, _ = strings.Cut(name, " ")
+		if !typed[name] {
+			t.Errorf("Sample for %s has no TYPE before it", name)
+		}
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  string
+	}{
+		{"plain", `"plain"`},
+		{`a"b`, `"a\"b"`},
+		{`a\b`, `"a\\b"`},
+		{"a\nb", `"a\nb"`},
+		// Only the three escapes the format knows are used.
+		{"a\tb", "\"a\tb\""},
+		{"ä", `"ä"`},
+	} {
+		if got := labelValue(tc.input); got != tc.want {
+			t.Errorf("%q: Got %s, Want %s", tc.input, got, tc.want)
+		}
+	}
+}
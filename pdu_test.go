@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"net/netip"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -372,3 +373,44 @@ func TestCacheResetPDU(t *testing.T) {
 		t.Errorf("PDU encoded is not what was expected. Got %+v, Wanted %+v\n", got, want)
 	}
 }
+
+func TestDecodePDUs(t *testing.T) {
+	for _, want := range []roa{
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxMask: 28, ASN: 64496},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 4200000000},
+	} {
+		var b []byte
+		if want.Prefix.Addr().Is4() {
+			b = (&ipv4PrefixPDU{flags: announce, min: 24, max: want.MaxMask, prefix: want.Prefix.Addr().As4(), asn: want.ASN}).append(nil, version1)
+		} else {
+			b = (&ipv6PrefixPDU{flags: announce, min: 32, max: want.MaxMask, prefix: want.Prefix.Addr().As16(), asn: want.ASN}).append(nil, version1)
+		}
+		got, flags, err := decodePrefixPDU(b)
+		if err != nil || got != want || flags != announce {
+			t.Errorf("Got %v with flags %d (%v), Want %v", got, flags, err, want)
+		}
+		if _, _, err := decodePrefixPDU(b[:len(b)-1]); err == nil {
+			t.Errorf("%v: truncated PDU was decoded", want)
+		}
+	}
+
+	eod := endOfDataPDU{session: 1, serial: 2, refresh: 3, retry: 4, expire: 5}
+	if got, err := decodeEndOfDataPDU(eod.append(nil, version1)); err != nil || got != eod {
+		t.Errorf("Got %+v (%v), Want %+v", got, err, eod)
+	}
+
+	e := errorReportPDU{code: 3, report: "no data available"}
+	if code, text := decodeErrorReportPDU(e.append(nil, version1)); code != e.code || text != e.report {
+		t.Errorf("Got error %d %q, Want %d %q", code, text, e.code, e.report)
+	}
+}
+
+func TestGetPDULength(t *testing.T) {
+	for _, length := range []uint32{0, 7, maxPDULength + 1} {
+		b := []byte{version1, cacheReset, 0, 0}
+		b = binary.BigEndian.AppendUint32(b, length)
+		if _, err := getPDU(bytes.NewReader(b)); err == nil {
+			t.Errorf("PDU of length %d was accepted", length)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+// privileges are what the server switches to once all listeners are bound.
+type privileges struct {
+	user    string
+	group   string
+	chroot  string
+	workdir string
+}
+
+// configured returns true if any privilege change has been asked for.
+func (p privileges) configured() bool {
+	return p.user != "" || p.group != "" || p.chroot != "" || p.workdir != ""
+}
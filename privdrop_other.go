@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// dropPrivileges is only supported on unix systems.
+func dropPrivileges(p privileges) error {
+	if p.configured() {
+		return fmt.Errorf("dropping privileges is not supported on this platform")
+	}
+	return nil
+}
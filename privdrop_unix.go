@@ -0,0 +1,115 @@
+//go:build unix
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges will chroot and change directory if asked, then switch to
+// the configured group and user. Anything that needs the old privileges or
+// the full filesystem must be opened before calling this.
+func dropPrivileges(p privileges) error {
+	if !p.configured() {
+		return nil
+	}
+
+	// Users and groups need to be looked up before a chroot hides /etc.
+	uid, gid, err := lookupIDs(p)
+	if err != nil {
+		return err
+	}
+
+	if p.chroot != "" {
+		// The system roots are cached on first use, so load them now while
+		// they can still be read for https sources.
+		if _, err := x509.SystemCertPool(); err != nil {
+			log.Printf("unable to load system certificates before chroot: %v\n", err)
+		}
+		if err := checkChroot(p.chroot); err != nil {
+			log.Printf("%v\n", err)
+		}
+		if err := syscall.Chroot(p.chroot); err != nil {
+			return fmt.Errorf("unable to chroot to %s: %w", p.chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("unable to change directory after chroot: %w", err)
+		}
+		log.Printf("Changed root to %s\n", p.chroot)
+	}
+	if p.workdir != "" {
+		if err := os.Chdir(p.workdir); err != nil {
+			return fmt.Errorf("unable to change directory to %s: %w", p.workdir, err)
+		}
+	}
+
+	// Group must be changed first, as we can't once we're no longer root.
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("unable to set supplementary groups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("unable to set gid to %d: %w", gid, err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("unable to set uid to %d: %w", uid, err)
+		}
+		// Make sure there is no way back.
+		if uid != 0 && syscall.Setuid(0) == nil {
+			return fmt.Errorf("able to regain root after dropping privileges")
+		}
+	}
+
+	log.Printf("Running as uid %d and gid %d\n", os.Getuid(), os.Getgid())
+	return nil
+}
+
+// lookupIDs returns the uid and gid to switch to, or -1 to keep the current
+// one. Root can leave a chroot, so one is only allowed along with a user.
+func lookupIDs(p privileges) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if p.chroot != "" && p.user == "" {
+		return -1, -1, fmt.Errorf("chroot to %s needs a user to switch to", p.chroot)
+	}
+	if p.user != "" {
+		u, err := user.Lookup(p.user)
+		if err != nil {
+			return -1, -1, fmt.Errorf("unable to find user %s: %w", p.user, err)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return -1, -1, fmt.Errorf("unable to use uid %s: %w", u.Uid, err)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return -1, -1, fmt.Errorf("unable to use gid %s: %w", u.Gid, err)
+		}
+	}
+	if p.group != "" {
+		g, err := user.LookupGroup(p.group)
+		if err != nil {
+			return -1, -1, fmt.Errorf("unable to find group %s: %w", p.group, err)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return -1, -1, fmt.Errorf("unable to use gid %s: %w", g.Gid, err)
+		}
+	}
+	return uid, gid, nil
+}
+
+// checkChroot returns why names may not resolve inside dir. They're looked
+// up in there, so it needs its own copy of /etc/resolv.conf and /etc/hosts
+// for http(s) and rtrs sources.
+func checkChroot(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "etc/resolv.conf")); err != nil {
+		return fmt.Errorf("no resolver config in %s, so source names may not resolve: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLookupIDs(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("unable to find the current user: %v", err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skipf("unable to find the current group: %v", err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	tests := []struct {
+		desc    string
+		p       privileges
+		wantUID int
+		wantGID int
+		wantErr bool
+	}{
+		{
+			desc:    "nothing configured",
+			wantUID: -1,
+			wantGID: -1,
+		},
+		{
+			desc:    "workdir only",
+			p:       privileges{workdir: "/"},
+			wantUID: -1,
+			wantGID: -1,
+		},
+		{
+			desc:    "user",
+			p:       privileges{user: u.Username},
+			wantUID: uid,
+			wantGID: gid,
+		},
+		{
+			desc:    "group",
+			p:       privileges{group: g.Name},
+			wantUID: -1,
+			wantGID: gid,
+		},
+		{
+			desc:    "chroot with a user",
+			p:       privileges{user: u.Username, chroot: "/var/empty"},
+			wantUID: uid,
+			wantGID: gid,
+		},
+		{
+			desc:    "chroot without a user",
+			p:       privileges{group: g.Name, chroot: "/var/empty"},
+			wantErr: true,
+		},
+		{
+			desc:    "unknown user",
+			p:       privileges{user: "rpkirtr-no-such-user"},
+			wantErr: true,
+		},
+		{
+			desc:    "unknown group",
+			p:       privileges{user: u.Username, group: "rpkirtr-no-such-group"},
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		uid, gid, err := lookupIDs(v.p)
+		if v.wantErr {
+			if err == nil {
+				t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error on %s: %v", v.desc, err)
+			continue
+		}
+		if uid != v.wantUID || gid != v.wantGID {
+			t.Errorf("Error on %s. Got uid %d gid %d, Want uid %d gid %d", v.desc, uid, gid, v.wantUID, v.wantGID)
+		}
+	}
+}
+
+func TestCheckChroot(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkChroot(dir); err == nil {
+		t.Errorf("Chroot without etc/resolv.conf should be warned about")
+	}
+	if err := os.Mkdir(filepath.Join(dir, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "etc/resolv.conf"), []byte("nameserver 192.0.2.53\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkChroot(dir); err != nil {
+		t.Errorf("Chroot with etc/resolv.conf was warned about: %v", err)
+	}
+}
+
+// Without a user or group nothing but the directory changes, whoever the
+// server is running as.
+func TestDropPrivilegesWithoutUser(t *testing.T) {
+	t.Chdir(t.TempDir())
+	uid, gid := os.Getuid(), os.Getgid()
+	if err := dropPrivileges(privileges{}); err != nil {
+		t.Errorf("Nothing configured returned %v", err)
+	}
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dropPrivileges(privileges{workdir: dir}); err != nil {
+		t.Fatalf("Changing only the directory returned %v", err)
+	}
+	if wd, _ := os.Getwd(); wd != dir {
+		t.Errorf("Got working directory %s, Want %s", wd, dir)
+	}
+	if os.Getuid() != uid || os.Getgid() != gid {
+		t.Errorf("Got uid %d gid %d, Want them unchanged at %d and %d", os.Getuid(), os.Getgid(), uid, gid)
+	}
+}
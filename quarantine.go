@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// thresholds are the sanity checks on every update. An update which breaks
+// one is quarantined rather than served. Percentages are of the VRPs being
+// served, and zero turns a check off.
+type thresholds struct {
+	minVRPs     int
+	maxWithdraw float64
+	maxAdd      float64
+}
+
+// quarantined is an update held back by the thresholds.
+type quarantined struct {
+	vrps       vrpSet
+	aggregated int
+	since      time.Time
+	reason     string
+	adds, dels int
+}
+
+// check returns why going from cur to next breaks the thresholds.
+func (t thresholds) check(cur, next *snapshot) error {
+	if n := next.vrps.len(); n < t.minVRPs {
+		return fmt.Errorf("update has %d VRPs, below min_vrps of %d", n, t.minVRPs)
+	}
+	// Percentages make no sense from nothing.
+	total := cur.vrps.len()
+	if total == 0 {
+		return nil
+	}
+	if pct := 100 * float64(len(next.diff.delRoa)) / float64(total); t.maxWithdraw > 0 && pct > t.maxWithdraw {
+		return fmt.Errorf("update withdraws %d VRPs (%.1f%%), above max_withdraw of %g%%", len(next.diff.delRoa), pct, t.maxWithdraw)
+	}
+	if pct := 100 * float64(len(next.diff.addRoa)) / float64(total); t.maxAdd > 0 && pct > t.maxAdd {
+		return fmt.Errorf("update adds %d VRPs (%.1f%%), above max_add of %g%%", len(next.diff.addRoa), pct, t.maxAdd)
+	}
+	return nil
+}
+
+// quarantineStatus returns the quarantined update, if any.
+func (s *CacheServer) quarantineStatus() *quarantined {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	return s.quarantine
+}
+
+// approveQuarantine publishes the quarantined update.
+func (s *CacheServer) approveQuarantine() (*snapshot, error) {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	q := s.quarantine
+	if q == nil {
+		return nil, errNoQuarantine
+	}
+	log.Printf("Quarantined update from %v approved\n", q.since.Format("2006-01-02 15:04:05"))
+	return s.publishLocked(q.vrps, q.aggregated, true)
+}
+
+// discardQuarantine drops the quarantined update. The current VRPs are served
+// until a source changes, and only that update is checked again.
+func (s *CacheServer) discardQuarantine() error {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	if s.quarantine == nil {
+		return errNoQuarantine
+	}
+	log.Printf("Quarantined update from %v discarded\n", s.quarantine.since.Format("2006-01-02 15:04:05"))
+	s.quarantine = nil
+	return nil
+}
+
+var errNoQuarantine = errors.New("no update is quarantined")
+
+// listenAdmin binds the admin HTTP server, which approves or discards the
+// quarantined update. Every request needs the token as a bearer token, which
+// a cross-site form can't send. Like listenHTTP, this is done before
+// dropping privileges.
+func (s *CacheServer) listenAdmin(addr, token string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen for admin on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /quarantine", s.quarantineHandler)
+	mux.HandleFunc("POST /quarantine/approve", s.approveHandler)
+	mux.HandleFunc("POST /quarantine/discard", s.discardHandler)
+
+	go func() {
+		log.Printf("Admin server started on %s\n", l.Addr().String())
+		if err := http.Serve(l, requireToken(token, mux)); err != nil {
+			log.Printf("Admin server on %s stopped: %v\n", addr, err)
+		}
+	}()
+	return nil
+}
+
+// requireToken only passes on requests with an Authorization header holding
+// the token.
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// quarantineHandler shows the quarantined update on GET. POST to
+// /quarantine/approve or /quarantine/discard on the admin server to act on it.
+func (s *CacheServer) quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	out := struct {
+		Quarantined bool      `json:"quarantined"`
+		Since       time.Time `json:"since,omitzero"`
+		Reason      string    `json:"reason,omitempty"`
+		VRPs        int       `json:"vrps,omitempty"`
+		Adds        int       `json:"adds,omitempty"`
+		Withdrawals int       `json:"withdrawals,omitempty"`
+	}{}
+	if q := s.quarantineStatus(); q != nil {
+		out.Quarantined = true
+		out.Since = q.since
+		out.Reason = q.reason
+		out.VRPs = q.vrps.len()
+		out.Adds = q.adds
+		out.Withdrawals = q.dels
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("unable to write quarantine response: %v\n", err)
+	}
+}
+
+func (s *CacheServer) approveHandler(w http.ResponseWriter, r *http.Request) {
+	snap, err := s.approveQuarantine()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	fmt.Fprintf(w, "published serial %d\n", snap.serial)
+}
+
+func (s *CacheServer) discardHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.discardQuarantine(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	fmt.Fprintln(w, "discarded")
+}
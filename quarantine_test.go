@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestThresholds(t *testing.T) {
+	cur := newSnapshot(newVRPSet(makeROAs(100, 0)), 1, 1, serialDiff{})
+	empty := newSnapshot(vrpSet{}, 0, 1, serialDiff{})
+	limits := thresholds{minVRPs: 50, maxWithdraw: 10, maxAdd: 20}
+
+	tests := []struct {
+		desc    string
+		cur     *snapshot
+		next    vrpSet
+		wantErr bool
+	}{
+		{
+			desc: "small change",
+			cur:  cur,
+			next: newVRPSet(makeROAs(100, 2)),
+		},
+		{
+			desc:    "too many withdrawn",
+			cur:     cur,
+			next:    newVRPSet(makeROAs(80, 0)),
+			wantErr: true,
+		},
+		{
+			desc:    "too many added",
+			cur:     cur,
+			next:    newVRPSet(makeROAs(130, 0)),
+			wantErr: true,
+		},
+		{
+			desc:    "empty",
+			cur:     cur,
+			next:    vrpSet{},
+			wantErr: true,
+		},
+		{
+			desc:    "below minimum from nothing",
+			cur:     empty,
+			next:    newVRPSet(makeROAs(40, 0)),
+			wantErr: true,
+		},
+		{
+			desc: "no percentages from nothing",
+			cur:  empty,
+			next: newVRPSet(makeROAs(100, 0)),
+		},
+	}
+	for _, v := range tests {
+		err := limits.check(v.cur, v.cur.next(v.next))
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	s := &CacheServer{
+		mutex:      &sync.RWMutex{},
+		thresholds: thresholds{minVRPs: 1, maxWithdraw: 10},
+	}
+	s.current.Store(newSnapshot(newVRPSet(makeROAs(100, 0)), 1, 1, serialDiff{}))
+
+	// Half the VRPs going is held back.
+	if _, err := s.publish(newVRPSet(makeROAs(50, 0)), 0, false); err == nil {
+		t.Fatalf("Large withdrawal was not quarantined")
+	}
+	if got := s.current.Load(); got.serial != 1 || got.vrps.len() != 100 {
+		t.Errorf("Quarantined update was published as serial %d with %d VRPs", got.serial, got.vrps.len())
+	}
+	if q := s.quarantineStatus(); q == nil || q.dels != 50 {
+		t.Fatalf("Got quarantine %+v, Want 50 withdrawals", q)
+	}
+
+	// Until it's approved.
+	rec := httptest.NewRecorder()
+	s.approveHandler(rec, httptest.NewRequest("POST", "/quarantine/approve", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Approve returned %d: %s", rec.Code, rec.Body)
+	}
+	if got := s.current.Load(); got.serial != 2 || got.vrps.len() != 50 {
+		t.Errorf("Approved update has serial %d with %d VRPs, Want serial 2 with 50", got.serial, got.vrps.len())
+	}
+	if s.quarantineStatus() != nil {
+		t.Errorf("Quarantine not cleared after approval")
+	}
+
+	// Discarded updates are never served.
+	if _, err := s.publish(vrpSet{}, 0, false); err == nil {
+		t.Fatalf("Empty update was not quarantined")
+	}
+	rec = httptest.NewRecorder()
+	s.discardHandler(rec, httptest.NewRequest("POST", "/quarantine/discard", nil))
+	if rec.Code != http.StatusOK || s.quarantineStatus() != nil {
+		t.Errorf("Discard returned %d, quarantine %+v", rec.Code, s.quarantineStatus())
+	}
+	rec = httptest.NewRecorder()
+	s.approveHandler(rec, httptest.NewRequest("POST", "/quarantine/approve", nil))
+	if rec.Code != http.StatusConflict || s.current.Load().serial != 2 {
+		t.Errorf("Approve with nothing quarantined returned %d", rec.Code)
+	}
+
+	// A good update clears any quarantine.
+	s.publish(vrpSet{}, 0, false)
+	if _, err := s.publish(newVRPSet(makeROAs(52, 0)), 0, false); err != nil {
+		t.Fatalf("Small update was quarantined: %v", err)
+	}
+	if s.quarantineStatus() != nil || s.current.Load().serial != 3 {
+		t.Errorf("Good update did not replace the quarantine")
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	}))
+	for _, tc := range []struct {
+		desc string
+		auth string
+		want int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong", http.StatusUnauthorized},
+		{"no scheme", "secret", http.StatusUnauthorized},
+		{"token", "Bearer secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/quarantine/approve", strings.NewReader("a=b"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: Got %d, Want %d", tc.desc, rec.Code, tc.want)
+		}
+	}
+}
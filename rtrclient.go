@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	rtrPort    = "323"
+	rtrTLSPort = "324"
+)
+
+// rtrClient follows an upstream cache over RTR, keeping a copy of its VRPs.
+// It starts with a Reset Query, then sends a Serial Query whenever the
+// upstream sends a Serial Notify or its refresh interval passes. Changes are
+// only applied once their End of Data arrives, so a half received update is
+// never seen. Queries are sent as version 1, or version 0 if the upstream
+// only supports that.
+type rtrClient struct {
+	addr    string
+	tls     *tls.Config
+	timeout time.Duration
+	// updated is signalled after every update that changed something.
+	updated chan struct{}
+
+	startOnce sync.Once
+	readyOnce sync.Once
+	ready     chan struct{}
+
+	mutex   sync.Mutex
+	vrps    vrpSet
+	version int
+	// synced is when the last End of Data arrived, and expire how long the
+	// upstream says the data can be used for without another.
+	synced time.Time
+	expire time.Duration
+	err    error
+}
+
+// rtrTable is the upstream session being followed. It's only used by the
+// client's own goroutine.
+type rtrTable struct {
+	// version is the protocol version used with the upstream. It starts at
+	// the highest the client supports, and drops if the upstream needs an
+	// older one.
+	version uint8
+	valid   bool
+	session uint16
+	serial  uint32
+	vrps    map[roa]struct{}
+}
+
+// rtrUpdate is a response being received, applied at its End of Data.
+type rtrUpdate struct {
+	reset    bool
+	announce []roa
+	withdraw []roa
+}
+
+var errRTRProtocol = errors.New("upstream broke the RTR protocol")
+
+// newRTRClient returns a client for an rtr:// or rtrs:// URL. rtrs is RTR
+// over TLS, checked against roots or the system roots if that's nil.
+func newRTRClient(u *url.URL, timeout time.Duration, roots *x509.CertPool) *rtrClient {
+	c := &rtrClient{
+		addr:    u.Host,
+		timeout: timeout,
+		updated: make(chan struct{}, 1),
+		ready:   make(chan struct{}),
+	}
+	port := rtrPort
+	if u.Scheme == "rtrs" {
+		port = rtrTLSPort
+		c.tls = &tls.Config{ServerName: u.Hostname(), RootCAs: roots}
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	return c
+}
+
+// start follows the upstream in the background, once.
+func (c *rtrClient) start() {
+	c.startOnce.Do(func() { go c.run() })
+}
+
+// run reconnects whenever the session is lost, backing off while it keeps
+// failing. What was last received is kept until it expires.
+func (c *rtrClient) run() {
+	table := rtrTable{version: version1}
+	for attempt := 0; ; attempt++ {
+		synced, err := c.follow(&table)
+		if synced {
+			attempt = 0
+		}
+		c.mutex.Lock()
+		c.err = err
+		c.mutex.Unlock()
+		wait := backoff(attempt)
+		log.Printf("lost upstream RTR cache %s, reconnecting in %v: %v\n", c.addr, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+	}
+}
+
+func (c *rtrClient) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: c.timeout}
+	if c.tls != nil {
+		return tls.DialWithDialer(d, "tcp", c.addr, c.tls)
+	}
+	return d.Dial("tcp", c.addr)
+}
+
+// follow runs a single connection until it fails, returning whether any End
+// of Data was received on it.
+func (c *rtrClient) follow(table *rtrTable) (bool, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	log.Printf("Connected to upstream RTR cache %s\n", c.addr)
+
+	// PDUs are read in their own goroutine, so queries can be sent on a
+	// timer while waiting.
+	pdus := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			pdu, err := getPDU(conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case pdus <- pdu:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	query := func() error {
+		var b []byte
+		if table.valid {
+			b = (&serialQueryPDU{Session: table.session, Serial: table.serial}).append(nil, table.version)
+		} else {
+			b = (&resetQueryPDU{}).append(nil, table.version)
+		}
+		conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		_, err := conn.Write(b)
+		return err
+	}
+	if err := query(); err != nil {
+		return false, err
+	}
+	// Until the response's End of Data, the timer is how long to wait for
+	// it. After, it's when to query again.
+	waiting := true
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	var update *rtrUpdate
+	var synced bool
+	// agreed is set once the upstream has answered in table.version.
+	var agreed bool
+
+	for {
+		select {
+		case err := <-readErr:
+			return synced, err
+		case <-timer.C:
+			if waiting {
+				return synced, fmt.Errorf("no End of Data within %v", c.timeout)
+			}
+			if err := query(); err != nil {
+				return synced, err
+			}
+			waiting = true
+			timer.Reset(c.timeout)
+			continue
+		case pdu := <-pdus:
+			if pdu[0] != table.version {
+				if agreed || pdu[0] > table.version {
+					return synced, fmt.Errorf("%w: version %d PDU", errRTRProtocol, pdu[0])
+				}
+				// An upstream which only supports an older version answers
+				// in that version, so start again with it (RFC 8210 section 7).
+				table.version = pdu[0]
+				table.valid = false
+				return synced, fmt.Errorf("upstream only supports version %d", pdu[0])
+			}
+			switch pdu[1] {
+			case serialNotify:
+				if !waiting {
+					if err := query(); err != nil {
+						return synced, err
+					}
+					waiting = true
+					timer.Reset(c.timeout)
+				}
+			case cacheResponse:
+				session := uint16(pdu[2])<<8 | uint16(pdu[3])
+				if table.valid && session != table.session {
+					table.valid = false
+					return synced, fmt.Errorf("%w: session changed from %d to %d", errRTRProtocol, table.session, session)
+				}
+				table.session = session
+				update = &rtrUpdate{reset: !table.valid}
+				agreed = true
+			case ipv4Prefix, ipv6Prefix:
+				if update == nil {
+					return synced, fmt.Errorf("%w: prefix outside of a response", errRTRProtocol)
+				}
+				r, flags, err := decodePrefixPDU(pdu)
+				if err != nil {
+					return synced, fmt.Errorf("%w: %v", errRTRProtocol, err)
+				}
+				if flags&announce != 0 {
+					update.announce = append(update.announce, r)
+				} else {
+					update.withdraw = append(update.withdraw, r)
+				}
+			case endOfData:
+				eod, err := decodeEndOfDataPDU(pdu)
+				if err != nil {
+					return synced, fmt.Errorf("%w: %v", errRTRProtocol, err)
+				}
+				if update == nil || eod.session != table.session {
+					return synced, fmt.Errorf("%w: unexpected End of Data", errRTRProtocol)
+				}
+				if err := c.apply(table, update, eod); err != nil {
+					table.valid = false
+					return synced, err
+				}
+				update = nil
+				synced = true
+				waiting = false
+				timer.Reset(time.Duration(min(max(eod.refresh, 1), 86400)) * time.Second)
+			case cacheReset:
+				// The upstream can't give us a diff, so start again.
+				log.Printf("Upstream RTR cache %s sent a cache reset\n", c.addr)
+				table.valid = false
+				if err := query(); err != nil {
+					return synced, err
+				}
+				waiting = true
+				timer.Reset(c.timeout)
+			case errorReport:
+				code, text := decodeErrorReportPDU(pdu)
+				if code == unsupportedVersion && !agreed && table.version > version0 {
+					table.version--
+					table.valid = false
+					return synced, fmt.Errorf("upstream doesn't support version %d: %s", table.version+1, text)
+				}
+				return synced, fmt.Errorf("upstream sent error %d: %s", code, text)
+			case routerKey:
+				// Only VRPs are relayed.
+			default:
+				return synced, fmt.Errorf("%w: unexpected PDU type %d", errRTRProtocol, pdu[1])
+			}
+		}
+	}
+}
+
+// apply makes the changes in update, then publishes the table if anything
+// changed. An announcement of a VRP already held, or the withdrawal of one
+// that isn't, means the tables are out of step.
+func (c *rtrClient) apply(table *rtrTable, update *rtrUpdate, eod endOfDataPDU) error {
+	if update.reset || table.vrps == nil {
+		table.vrps = make(map[roa]struct{}, len(update.announce))
+	}
+	for _, r := range update.withdraw {
+		if _, ok := table.vrps[r]; !ok {
+			return fmt.Errorf("%w: withdrawal of unknown VRP %v", errRTRProtocol, r)
+		}
+		delete(table.vrps, r)
+	}
+	for _, r := range update.announce {
+		if _, ok := table.vrps[r]; ok {
+			return fmt.Errorf("%w: duplicate announcement of VRP %v", errRTRProtocol, r)
+		}
+		table.vrps[r] = struct{}{}
+	}
+	table.valid = true
+	table.serial = eod.serial
+
+	c.mutex.Lock()
+	changed := update.reset || len(update.announce) > 0 || len(update.withdraw) > 0
+	if changed {
+		var vrps vrpSet
+		for r := range table.vrps {
+			vrps.add(r)
+		}
+		vrps.normalize()
+		c.vrps = vrps
+		c.version++
+	}
+	c.synced = time.Now()
+	c.expire = time.Duration(eod.expire) * time.Second
+	c.err = nil
+	c.mutex.Unlock()
+
+	log.Printf("Upstream RTR cache %s is at serial %d with %d VRPs\n", c.addr, eod.serial, len(table.vrps))
+	c.readyOnce.Do(func() { close(c.ready) })
+	if changed {
+		select {
+		case c.updated <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// latest returns the VRPs last received along with a count of updates, so
+// callers can tell if anything changed. It's an error once the upstream's
+// expire interval has passed without hearing from it.
+func (c *rtrClient) latest() (vrpSet, int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if age := time.Since(c.synced); age > c.expire {
+		return vrpSet{}, 0, fmt.Errorf("nothing from upstream for %v, past its expire interval: %v", age.Round(time.Second), c.err)
+	}
+	return c.vrps, c.version, nil
+}
+
+// fetchRTR returns the VRPs from an upstream cache, waiting for the first
+// update if there hasn't been one yet.
+func (src *source) fetchRTR() (vrpSet, bool, error) {
+	c := src.rtr
+	c.start()
+	select {
+	case <-c.ready:
+	case <-time.After(src.timeout):
+		c.mutex.Lock()
+		err := c.err
+		c.mutex.Unlock()
+		return vrpSet{}, false, fmt.Errorf("no update from upstream within %v: %v", src.timeout, err)
+	}
+	vrps, version, err := c.latest()
+	if err != nil {
+		return vrpSet{}, false, err
+	}
+	src.mutex.Lock()
+	changed := version != src.rtrVersion
+	src.rtrVersion = version
+	src.vrps = vrps
+	src.mutex.Unlock()
+	if changed {
+		log.Printf("Returning %d ROAs from %s\n", vrps.len(), src.name)
+	}
+	return vrps, changed, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeUpstream is the cache side of a single RTR connection.
+type fakeUpstream struct {
+	t       *testing.T
+	conn    net.Conn
+	version uint8
+}
+
+// listenUpstream returns the address of a fake upstream cache, and a function
+// returning its next connection.
+func listenUpstream(t *testing.T) (string, func() *fakeUpstream) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conns := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	accept := func() *fakeUpstream {
+		select {
+		case conn := <-conns:
+			t.Cleanup(func() { conn.Close() })
+			return &fakeUpstream{t: t, conn: conn, version: version1}
+		case <-time.After(5 * time.Second):
+			t.Fatal("client never connected")
+		}
+		return nil
+	}
+	return ln.Addr().String(), accept
+}
+
+// expect reads the next PDU, failing unless it's of type ptype.
+func (u *fakeUpstream) expect(ptype uint8) []byte {
+	u.t.Helper()
+	u.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	pdu, err := getPDU(u.conn)
+	if err != nil {
+		u.t.Fatalf("reading from client: %v", err)
+	}
+	if pdu[0] != u.version || pdu[1] != ptype {
+		u.t.Fatalf("Got PDU type %d version %d, Want %d version %d", pdu[1], pdu[0], ptype, u.version)
+	}
+	return pdu
+}
+
+// respond sends a cache response with the given prefixes, then an end of data.
+func (u *fakeUpstream) respond(serial uint32, announced, withdrawn []roa) {
+	u.t.Helper()
+	b := (&cacheResponsePDU{sessionID: 7}).append(nil, u.version)
+	for flags, roas := range [][]roa{withdrawn, announced} {
+		for _, r := range roas {
+			if r.Prefix.Addr().Is4() {
+				b = (&ipv4PrefixPDU{flags: uint8(flags), min: uint8(r.Prefix.Bits()), max: r.MaxMask, prefix: r.Prefix.Addr().As4(), asn: r.ASN}).append(b, u.version)
+			} else {
+				b = (&ipv6PrefixPDU{flags: uint8(flags), min: uint8(r.Prefix.Bits()), max: r.MaxMask, prefix: r.Prefix.Addr().As16(), asn: r.ASN}).append(b, u.version)
+			}
+		}
+	}
+	b = (&endOfDataPDU{session: 7, serial: serial, refresh: 3600, retry: 600, expire: 7200}).append(b, u.version)
+	u.write(b)
+}
+
+func (u *fakeUpstream) write(b []byte) {
+	u.t.Helper()
+	if _, err := u.conn.Write(b); err != nil {
+		u.t.Fatalf("writing to client: %v", err)
+	}
+}
+
+func TestRTRSource(t *testing.T) {
+	addr, accept := listenUpstream(t)
+	updated := func(src *source) {
+		select {
+		case <-src.rtr.updated:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update from client")
+		}
+	}
+	check := func(desc string, src *source, wantChanged bool, want []roa) {
+		t.Helper()
+		got, changed, err := src.fetch()
+		if err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		if changed != wantChanged {
+			t.Errorf("%s: Got changed %t, Want %t", desc, changed, wantChanged)
+		}
+		if !reflect.DeepEqual(got.roas(), newVRPSet(want).roas()) {
+			t.Errorf("%s: Got %v, Want %v", desc, got.roas(), want)
+		}
+	}
+
+	a := roa{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	b := roa{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 64497}
+	c := roa{Prefix: netip.MustParsePrefix("198.51.100.0/24"), MaxMask: 24, ASN: 64498}
+
+	src := newSources([]sourceConfig{{name: "upstream", url: "rtr://" + addr, timeout: 5 * time.Second}})[0]
+	fetched := make(chan struct{})
+	go func() {
+		defer close(fetched)
+		check("first", src, true, []roa{a, b})
+	}()
+	up := accept()
+	up.expect(resetQuery)
+	up.respond(1, []roa{a, b}, nil)
+	updated(src)
+	<-fetched
+	check("unchanged", src, false, []roa{a, b})
+
+	// A serial notify is followed by a serial query from the last serial.
+	up.write((&serialNotifyPDU{Session: 7, Serial: 2}).append(nil, version1))
+	if q := getSerialQueryPDU(up.expect(serialQuery)[2:]); q.Session != 7 || q.Serial != 1 {
+		t.Errorf("Got serial query %+v, Want session 7 and serial 1", q)
+	}
+	up.respond(2, []roa{c}, []roa{a})
+	updated(src)
+	check("incremental", src, true, []roa{b, c})
+
+	// After a cache reset, the next response replaces everything.
+	up.write((&serialNotifyPDU{Session: 7, Serial: 3}).append(nil, version1))
+	up.expect(serialQuery)
+	up.write((&cacheResetPDU{}).append(nil, version1))
+	up.expect(resetQuery)
+	up.respond(3, []roa{a}, nil)
+	updated(src)
+	check("reset", src, true, []roa{a})
+
+	// Withdrawing a VRP the client doesn't have drops the connection, but
+	// the last VRPs are kept while the client reconnects.
+	up.write((&serialNotifyPDU{Session: 7, Serial: 4}).append(nil, version1))
+	up.expect(serialQuery)
+	up.respond(4, nil, []roa{b})
+	up.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := getPDU(up.conn); err != io.EOF {
+		t.Errorf("Got %v, Want the connection to be closed", err)
+	}
+	check("kept", src, false, []roa{a})
+	up = accept()
+	up.expect(resetQuery)
+}
+
+func TestRTRVersionNegotiation(t *testing.T) {
+	a := roa{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496}
+	for _, tc := range []struct {
+		desc  string
+		reply func(u *fakeUpstream)
+	}{
+		{"error report", func(u *fakeUpstream) {
+			u.write((&errorReportPDU{code: unsupportedVersion, report: "version 0 only"}).append(nil, version0))
+		}},
+		{"error report in version 1", func(u *fakeUpstream) {
+			u.write((&errorReportPDU{code: unsupportedVersion}).append(nil, version1))
+		}},
+		{"response in version 0", func(u *fakeUpstream) {
+			u.version = version0
+			u.respond(1, []roa{a}, nil)
+		}},
+	} {
+		addr, accept := listenUpstream(t)
+		src := newSources([]sourceConfig{{name: "upstream", url: "rtr://" + addr, timeout: 5 * time.Second}})[0]
+		src.rtr.start()
+
+		// The first query is version 1, and after the upstream says it only
+		// has version 0 the client reconnects with that.
+		up := accept()
+		up.expect(resetQuery)
+		tc.reply(up)
+		up.conn.Close()
+		up = accept()
+		up.version = version0
+		up.expect(resetQuery)
+		up.respond(1, []roa{a}, nil)
+		select {
+		case <-src.rtr.updated:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no update from client", tc.desc)
+		}
+		got, _, err := src.fetch()
+		if err != nil || !reflect.DeepEqual(got.roas(), []roa{a}) {
+			t.Errorf("%s: Got %v, %v, Want %v", tc.desc, got.roas(), err, a)
+		}
+
+		// Later queries stay at version 0.
+		up.write((&serialNotifyPDU{Session: 7, Serial: 2}).append(nil, version0))
+		up.expect(serialQuery)
+	}
+}
+
+func TestNewRTRClient(t *testing.T) {
+	for _, tc := range []struct {
+		url     string
+		addr    string
+		withTLS bool
+	}{
+		{url: "rtr://rtr.example.net", addr: "rtr.example.net:323"},
+		{url: "rtr://rtr.example.net:8282", addr: "rtr.example.net:8282"},
+		{url: "rtrs://rtr.example.net", addr: "rtr.example.net:324", withTLS: true},
+		{url: "rtr://[2001:db8::1]", addr: "[2001:db8::1]:323"},
+	} {
+		src := newSources([]sourceConfig{{url: tc.url}})[0]
+		if src.rtr == nil {
+			t.Errorf("%s: no RTR client", tc.url)
+			continue
+		}
+		if src.rtr.addr != tc.addr || (src.rtr.tls != nil) != tc.withTLS {
+			t.Errorf("%s: Got %s (TLS %t), Want %s (TLS %t)", tc.url, src.rtr.addr, src.rtr.tls != nil, tc.addr, tc.withTLS)
+		}
+	}
+}
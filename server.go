@@ -4,6 +4,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -13,11 +14,10 @@ import (
 	"os"
 	"path"
 	"runtime"
-	"strings"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"gopkg.in/ini.v1"
 )
 
 const (
@@ -35,19 +35,54 @@ type roa struct {
 	Prefix  netip.Prefix
 	MaxMask uint8
 	ASN     uint32
+	// Expires is when the VRP stops being valid in unix seconds, or zero if
+	// it never does.
+	Expires int64
+	// TAs are the trust anchors the VRP was issued under, as bits from
+	// trustAnchors.
+	TAs uint32
 }
 
 // CacheServer is our RPKI cache server.
 type CacheServer struct {
+	listeners []*listener
+	clients   []*client
+	current   atomic.Pointer[snapshot]
+	mutex     *sync.RWMutex
+	session   uint16
+	updates   checkErrorUpdate
+	sources   []*source
+	state     *stateFile
+	aggregate bool
+
+	// Publishing a snapshot, and the quarantine, are serialized by this.
+	publishMutex sync.Mutex
+	thresholds   thresholds
+	quarantine   *quarantined
+
+	merge mergePolicy
+	// filters is the local policy applied to every update.
+	filters *filterChain
+	// slurm is local exceptions, applied after the filters.
+	slurm *slurm
+	// validated is the last merged set from the sources before any local
+	// policy, so it can be applied again when a SLURM file changes.
+	validated     vrpSet
+	haveValidated bool
+	// refreshNow starts a refresh straight away, when a watched file or an
+	// upstream cache changes.
+	refreshNow chan struct{}
+	// published is signalled after each publish, so the next expiry can be
+	// found again.
+	published chan struct{}
+}
+
+// listener is a single bound address. Clients are labelled with the listener
+// they came in on.
+type listener struct {
+	label    string
 	listener net.Listener
-	clients  []*client
-	roas     []roa
-	mutex    *sync.RWMutex
-	serial   uint32
-	session  uint16
-	diff     serialDiff
-	updates  checkErrorUpdate
-	urls     []string
+	accepted uint64
 }
 
 // checkErrorUpdate will let us know timings of ROA updates.
@@ -83,23 +118,18 @@ func run() error {
 		return err
 	}
 	path := fmt.Sprintf("%s/config.ini", path.Dir(exe))
-	cf, err := ini.Load(path)
+	cf, err := loadConfig(path)
 	if err != nil {
-		log.Fatalf("failed to read config file: %v\n", err)
-	}
-	logf := cf.Section("rpkirtr").Key("log").String()
-	port, err := cf.Section("rpkirtr").Key("port").Int64()
-	if err != nil {
-		return fmt.Errorf("port set needs to be a number: %v", err)
+		return err
 	}
 
 	// grab URLs
 	jsons := flag.String("urls", "", "json locations of VRPs")
 	flag.Parse()
-	urls := strings.Split(*jsons, ",")
+	urls := splitList(*jsons)
 
 	// set up logging
-	f, err := os.OpenFile(logf, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	f, err := os.OpenFile(cf.log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
 	if err != nil {
 		return fmt.Errorf("failed to open logfile: %w", err)
 	}
@@ -109,46 +139,118 @@ func run() error {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.SetOutput(f)
 
-	// We need our initial set of ROAs.
-	roas, err := readROAs(urls)
-	init := time.Now() // Use this value to save time of first roa update.
-	if err != nil {
-		return fmt.Errorf("unable to download ROAs, aborting: %w", err)
+	// Set up our server. Data is added once we're running unprivileged.
+	rpki := CacheServer{
+		mutex:      &sync.RWMutex{},
+		session:    uint16(rand.IntN(65535)),
+		sources:    newSources(append(cf.sources, cf.urlSources(urls)...)),
+		aggregate:  cf.aggregate,
+		thresholds: cf.thresholds,
+		merge:      cf.merge,
+		filters:    cf.filters,
+		slurm:      cf.slurm,
+		refreshNow: make(chan struct{}, 1),
+		published:  make(chan struct{}, 1),
+	}
+	if err := rpki.merge.check(len(rpki.sources)); err != nil {
+		return err
 	}
-	log.Println("Initial roa set downloaded")
 
-	// Set up our server with it's initial data.
-	rpki := CacheServer{
-		mutex:   &sync.RWMutex{},
-		session: uint16(rand.IntN(65535)),
-		roas:    roas,
-		updates: checkErrorUpdate{
-			lastCheck: init,
-		},
-		urls: urls,
+	// I'm listening! Privileged ports need to be bound before dropping.
+	if err := rpki.listen(cf.listen); err != nil {
+		return err
+	}
+	if cf.http != "" {
+		if err := rpki.listenHTTP(cf.http); err != nil {
+			rpki.close()
+			return err
+		}
+	}
+	if cf.admin != "" {
+		if err := rpki.listenAdmin(cf.admin, cf.adminToken); err != nil {
+			rpki.close()
+			return err
+		}
+	}
+	// The state directory may be outside of the chroot.
+	if cf.state != "" {
+		if rpki.state, err = openStateFile(cf.state); err != nil {
+			rpki.close()
+			return err
+		}
+	}
+	// File sources and SLURM files may be too, and are watched from here on.
+	if err := rpki.openFiles(); err != nil {
+		rpki.close()
+		return err
+	}
+	rpki.watchSources()
+	if err := dropPrivileges(cf.privileges); err != nil {
+		rpki.close()
+		return fmt.Errorf("unable to drop privileges: %w", err)
+	}
+	if _, err := rpki.slurm.reload(); err != nil {
+		rpki.close()
+		return fmt.Errorf("unable to load SLURM: %w", err)
+	}
+
+	// Start from the state file if there is one, as it's much quicker than
+	// downloading everything. Otherwise we need our initial set of ROAs.
+	loaded := rpki.loadState(cf.stateMaxAge)
+	if !loaded {
+		if len(rpki.sources) == 0 {
+			rpki.close()
+			return errors.New("no sources given and no state file to load")
+		}
+		roas, _, err := readROAs(rpki.sources, rpki.merge)
+		init := time.Now() // Use this value to save time of first roa update.
+		if err != nil {
+			rpki.close()
+			return fmt.Errorf("unable to download ROAs, aborting: %w", err)
+		}
+		log.Println("Initial roa set downloaded")
+		rpki.validated, rpki.haveValidated = roas, true
+		roas, removed := rpki.process(roas)
+		if roas.len() < rpki.thresholds.minVRPs {
+			rpki.close()
+			return fmt.Errorf("only %d VRPs downloaded, below min_vrps of %d", roas.len(), rpki.thresholds.minVRPs)
+		}
+		snap := newSnapshot(roas, 0, rpki.session, serialDiff{})
+		snap.aggregated = removed
+		rpki.current.Store(snap)
+		rpki.updates.lastCheck = init
+		rpki.saveState(snap)
 	}
 
+	rpki.startUpstreams()
+
 	ch := make(chan bool)
 	go rpki.status(ch)
 	// keep ROAs updated.
-	go rpki.updateROAs(ch)
+	go rpki.updateROAs(ch, loaded)
+	go rpki.expireROAs(ch)
 
-	// I'm listening!
-	rpki.listen(port)
 	defer rpki.close()
 	rpki.start()
 
 	return nil
 }
 
-// Start listening
-func (s *CacheServer) listen(port int64) {
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		panic(err)
+// listen binds each of the configured addresses.
+func (s *CacheServer) listen(addrs []string) error {
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.close()
+			return fmt.Errorf("unable to listen on %s: %w", addr, err)
+		}
+		s.listeners = append(s.listeners, &listener{
+			label:    addr,
+			listener: l,
+		})
+		log.Printf("Server started on %s\n", l.Addr().String())
 	}
-	s.listener = l
-	log.Printf("Server started on port %d\n", port)
+	return nil
 }
 
 // Log current ROA status
@@ -158,39 +260,95 @@ func (s *CacheServer) status(ch chan bool) {
 		<-ch
 		log.Println("received true over the channel")
 
+		snap := s.current.Load()
+		q := s.quarantineStatus()
 		s.mutex.RLock()
-		// Count how many ROAs we have.
-		var v4, v6 int
-		for _, r := range s.roas {
-			if r.Prefix.Addr().Is4() {
-				v4++
-			} else {
-				v6++
-			}
-		}
+		v4, v6 := len(snap.vrps.v4), len(snap.vrps.v6)
 
 		log.Println("*** Status ***")
 		log.Printf("I currently have %d clients connected\n", len(s.clients))
 		for i, v := range s.clients {
-			log.Printf("%d: %s\n", i+1, v.addr)
+			log.Printf("%d: %s on %s\n", i+1, v.addr, v.listener)
+			if t := v.tcpStats(); !t.sampled.IsZero() {
+				log.Printf("\trtt %v (var %v), retransmits %d, send queue %d bytes, cwnd %d, sampled %v\n",
+					t.rtt, t.rttVar, t.retransmits, t.sendQueue, t.cwnd, t.sampled.Format("2006-01-02 15:04:05"))
+			}
+		}
+		for _, l := range s.listeners {
+			var connected int
+			for _, c := range s.clients {
+				if c.listener == l.label {
+					connected++
+				}
+			}
+			log.Printf("Listener %s has %d clients connected, %d accepted in total\n",
+				l.label, connected, atomic.LoadUint64(&l.accepted))
 		}
-		log.Printf("Current serial number is %d\n", s.serial)
-		log.Printf("Last diff is %t\n", s.diff.diff)
-		log.Printf("Current size of diff is %d\n", len(s.diff.addRoa)+len(s.diff.delRoa))
-		if len(s.diff.addRoa) > 0 {
+		if fo := s.merge.failover; fo != nil && len(s.sources) > 0 {
+			active, switches, events := fo.status()
+			log.Printf("Serving source %s, %d switches so far\n", s.sources[active].name, switches)
+			if len(events) > 0 {
+				ev := events[len(events)-1]
+				log.Printf("\tlast switch was from %s to %s at %v: %s\n", ev.From, ev.To, ev.Time.Format("2006-01-02 15:04:05"), ev.Reason)
+			}
+		}
+		for _, src := range s.sources {
+			st := src.lastStatus()
+			log.Printf("Source %s has %d ROAs, last fetch took %v\n", src.name, st.vrps, st.duration.Round(time.Millisecond))
+			if st.rejected > 0 || st.missing > 0 {
+				log.Printf("\t%d ROAs not published by %s, missing %d published ROAs\n", st.rejected, s.merge.name, st.missing)
+			}
+			if !st.lastSuccess.IsZero() {
+				log.Printf("\tlast success was %v\n", st.lastSuccess.Format("2006-01-02 15:04:05"))
+			}
+			if m := st.meta; !m.generated.IsZero() {
+				log.Printf("\tgenerated at %v, with %d failed and %d invalid ROAs\n",
+					m.generated.Format("2006-01-02 15:04:05"), m.failedROAs, m.invalidROAs)
+			}
+			if st.stale != nil {
+				log.Printf("ALERT: %s is stale: %v\n", src.name, st.stale)
+			}
+			if st.err != nil {
+				log.Printf("\tlast error was %v: %v\n", st.lastError.Format("2006-01-02 15:04:05"), st.err)
+			}
+		}
+		if q != nil {
+			log.Printf("ALERT: update with %d VRPs (%d adds, %d withdrawals) quarantined since %v: %s\n",
+				q.vrps.len(), q.adds, q.dels, q.since.Format("2006-01-02 15:04:05"), q.reason)
+		}
+		log.Printf("Current serial number is %d\n", snap.serial)
+		log.Printf("Last diff is %t\n", snap.diff.diff)
+		log.Printf("Current size of diff is %d\n", len(snap.diff.addRoa)+len(snap.diff.delRoa))
+		if len(snap.diff.addRoa) > 0 {
 			log.Printf("ROAs to be added:")
-			for _, v := range s.diff.addRoa {
+			for _, v := range snap.diff.addRoa {
 				log.Printf("%s Mask %d ASN %d", v.Prefix.Addr().String(), v.Prefix.Bits(), v.ASN)
 			}
 		}
-		if len(s.diff.delRoa) > 0 {
+		if len(snap.diff.delRoa) > 0 {
 			log.Printf("ROAs to be deleted:")
-			for _, v := range s.diff.delRoa {
+			for _, v := range snap.diff.delRoa {
 				log.Printf("%s Mask %d ASN %d", v.Prefix.Addr().String(), v.Prefix.Bits(), v.ASN)
 			}
 		}
-		log.Printf("There are %d ROAs\n", len(s.roas))
+		log.Printf("There are %d ROAs\n", snap.vrps.len())
 		log.Printf("There are %d IPv4 ROAs and %d IPv6 ROAs\n", v4, v6)
+		if s.aggregate {
+			log.Printf("Aggregation removed %d ROAs\n", snap.aggregated)
+		}
+		for _, f := range s.filters.status() {
+			log.Printf("Filter %s removed or changed %d ROAs\n", f.rule, f.count)
+		}
+		if st := s.slurm.status(); st != nil {
+			log.Printf("SLURM filtered %d ROAs and asserted %d, from %d entries loaded at %v\n",
+				st.filtered, st.asserted, len(st.entries), st.loaded.Format("2006-01-02 15:04:05"))
+			for _, e := range st.entries {
+				log.Printf("\t%s %s in %s matched %d\n", e.kind, e, e.file, e.matched)
+			}
+			if st.err != nil {
+				log.Printf("ALERT: SLURM files not reloaded: %v\n", st.err)
+			}
+		}
 		if !s.updates.lastCheck.IsZero() {
 			log.Printf("Last check was %v\n", s.updates.lastCheck.Format("2006-01-02 15:04:05"))
 		}
@@ -216,29 +374,50 @@ func bToMb(b uint64) uint64 {
 	return b / 1024 / 1024
 }
 
-// close off the listener if existing
+// close off the listeners if existing
 func (s *CacheServer) close() {
-	s.listener.Close()
+	for _, l := range s.listeners {
+		l.listener.Close()
+	}
 }
 
-// start will start the listener as well as accept client and handle each.
+// start will run an accept loop for each listener and block until they
+// have all stopped.
 func (s *CacheServer) start() {
+	var wg sync.WaitGroup
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(l)
+		}()
+	}
+	wg.Wait()
+}
+
+// serve will accept clients on a single listener and handle each.
+func (s *CacheServer) serve(l *listener) {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.listener.Accept()
 		if err != nil {
-			log.Printf("%v\n", err)
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("Listener %s closed\n", l.label)
+				return
+			}
+			log.Printf("%s: %v\n", l.label, err)
 			continue
 		}
+		atomic.AddUint64(&l.accepted, 1)
 
-		client := s.accept(conn)
+		client := s.accept(conn, l.label)
 		go s.handleClient(client)
 	}
 }
 
 // accept adds a new client to the current list of clients being served.
-func (s *CacheServer) accept(conn net.Conn) *client {
-	log.Printf("Connection from %v, total clients: %d\n",
-		conn.RemoteAddr().String(), len(s.clients)+1)
+func (s *CacheServer) accept(conn net.Conn, label string) *client {
+	log.Printf("Connection from %v on %s, total clients: %d\n",
+		conn.RemoteAddr().String(), label, len(s.clients)+1)
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -246,14 +425,15 @@ func (s *CacheServer) accept(conn net.Conn) *client {
 	// TODO: Handle the error
 	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
-	// Each client will have a pointer to a load of the server's data.
+	// Each client can load the server's current snapshot.
 	client := &client{
-		conn:   conn,
-		addr:   ip,
-		roas:   &s.roas,
-		serial: &s.serial,
-		mutex:  s.mutex,
-		diff:   &s.diff,
+		conn:     conn,
+		addr:     ip,
+		remote:   conn.RemoteAddr().String(),
+		listener: label,
+		current:  &s.current,
+		queue:    make(chan response, clientQueueSize),
+		done:     make(chan struct{}),
 	}
 
 	s.clients = append(s.clients, client)
@@ -275,42 +455,211 @@ func (s *CacheServer) remove(c *client) {
 	}
 }
 
-// updateROAs will update the server struct with the current list of ROAs
-func (s *CacheServer) updateROAs(ch chan bool) {
-	for {
-		time.Sleep(refreshROA)
-		s.mutex.Lock()
-		s.updates.lastCheck = time.Now()
+// process runs the optional steps applied to every new set of VRPs before
+// it's published. It returns the set along with how many VRPs aggregation
+// removed. Filters come first, so nothing is aggregated away in to a VRP
+// that's then filtered. SLURM is next, so its assertions are never filtered.
+func (s *CacheServer) process(roas vrpSet) (vrpSet, int) {
+	roas = s.filters.apply(roas)
+	for _, f := range s.filters.status() {
+		if f.count > 0 {
+			log.Printf("Filter %s removed or changed %d VRPs\n", f.rule, f.count)
+		}
+	}
+	roas = s.slurm.apply(roas)
+	if st := s.slurm.status(); st != nil {
+		log.Printf("SLURM filtered %d VRPs and asserted %d\n", st.filtered, st.asserted)
+	}
+	if !s.aggregate {
+		return roas, 0
+	}
+	before := roas.len()
+	roas, removed := roas.aggregate()
+	if before > 0 {
+		log.Printf("Aggregation removed %d of %d VRPs (%.1f%%)\n", removed, before, 100*float64(removed)/float64(before))
+	}
+	return roas, removed
+}
 
-		roas, err := readROAs(s.urls)
-		if err != nil {
-			log.Printf("Unable to update ROAs, so keeping existing ROAs for now: %v\n", err)
-			s.updates.lastError = time.Now()
-			s.mutex.Unlock()
-			log.Println("will send true over the channel")
-			ch <- true
-			continue
+// updateROAs will publish a new snapshot with the current list of ROAs.
+// Downloading and diffing is done without holding any lock, and clients
+// keep using the previous snapshot until the new one is swapped in.
+// If we started from a saved state, the first download is done straight away.
+// A change to a watched file or upstream cache refreshes straight away, but
+// only the watched sources are fetched, so the timer carries on for the rest.
+func (s *CacheServer) updateROAs(ch chan bool, loaded bool) {
+	if loaded && len(s.sources) > 0 {
+		s.refresh(ch, true)
+	}
+	timer := time.NewTimer(refreshROA)
+	for {
+		select {
+		case <-timer.C:
+			s.refresh(ch, true)
+			timer.Reset(refreshROA)
+		case <-s.refreshNow:
+			log.Println("Refreshing early as a watched source has changed")
+			s.refresh(ch, false)
 		}
+	}
+}
 
-		// Calculate diffs
-		s.diff = makeDiff(roas, s.roas, s.serial)
-		if s.diff.diff {
-			s.updates.lastUpdate = time.Now()
+// expireROAs withdraws VRPs as they expire, without waiting for the next
+// refresh. Everything expiring within the same expiryWindow is withdrawn at
+// once. This carries on while fetches are failing.
+func (s *CacheServer) expireROAs(ch chan bool) {
+	for {
+		var expiry <-chan time.Time
+		if next := s.current.Load().vrps.nextExpiry(); !next.IsZero() {
+			expiry = time.After(time.Until(expiryDue(next)))
 		}
+		select {
+		case <-expiry:
+			s.expire(ch)
+		case <-s.published:
+		}
+	}
+}
+
+// expire publishes the current VRPs without those that have expired. An
+// expiry isn't a new update, so thresholds aren't checked and anything
+// quarantined is left alone.
+func (s *CacheServer) expire(ch chan bool) {
+	s.publishMutex.Lock()
+	cur := s.current.Load()
+	if _, n := cur.vrps.unexpired(expiryCutoff(time.Now())); n == 0 {
+		s.publishMutex.Unlock()
+		return
+	}
+	q := s.quarantine
+	_, err := s.publishLocked(cur.vrps, cur.aggregated, true)
+	s.quarantine = q
+	s.publishMutex.Unlock()
+	if err != nil {
+		log.Printf("unable to withdraw expired ROAs: %v\n", err)
+	}
+	ch <- true
+}
+
+// refresh downloads the latest ROAs and publishes them. With no urls, the
+// state file is the only source, so it's reloaded if it has been replaced.
+// If only the SLURM files have changed, the last ROAs are published again
+// with the new exceptions. Unless all is set, only watched sources are
+// fetched.
+func (s *CacheServer) refresh(ch chan bool, all bool) {
+	s.mutex.Lock()
+	s.updates.lastCheck = time.Now()
+	s.mutex.Unlock()
 
-		// Increment serial and replace
-		s.serial++
-		s.roas = roas
-		log.Printf("roas updated, serial is now %d\n", s.serial)
+	reapply, err := s.slurm.reload()
+	if err != nil {
+		log.Printf("ALERT: keeping the previous SLURM exceptions: %v\n", err)
+	}
 
+	var roas vrpSet
+	var changed bool
+	if len(s.sources) > 0 {
+		if roas, changed, err = readSources(s.sources, s.merge, all); err == nil && !changed {
+			log.Println("No sources have changed, keeping existing ROAs")
+		}
+	} else {
+		roas, changed, err = s.reloadState()
+	}
+	if err != nil {
+		log.Printf("Unable to update ROAs, so keeping existing ROAs for now: %v\n", err)
+		s.mutex.Lock()
+		s.updates.lastError = time.Now()
 		s.mutex.Unlock()
+	}
+
+	switch {
+	case err == nil && changed:
+		// saveState reads this when publishing from the expiry goroutine.
+		s.publishMutex.Lock()
+		s.validated, s.haveValidated = roas, true
+		s.publishMutex.Unlock()
+	case reapply:
+		// New SLURM exceptions are applied even if the fetch failed. A
+		// server started from the state file only has what it published.
+		log.Println("Applying the new SLURM exceptions to the last ROAs")
+		roas = s.validated
+		if !s.haveValidated {
+			roas = s.current.Load().vrps
+		}
+	case err != nil:
 		log.Println("will send true over the channel")
 		ch <- true
+		return
+	default:
+		return
+	}
+
+	roas, removed := s.process(roas)
+	if _, err := s.publish(roas, removed, false); err != nil {
+		log.Printf("ALERT: %v\n", err)
+	}
+	log.Println("will send true over the channel")
+	ch <- true
+}
 
-		// Notify all clients that the serial number has been updated.
-		for _, c := range s.clients {
-			log.Printf("sending a notify to %s\n", c.addr)
-			c.notify(s.serial, s.session)
+// publish swaps in a snapshot of roas unless it breaks the thresholds, in
+// which case it's quarantined instead. force skips the thresholds.
+func (s *CacheServer) publish(roas vrpSet, aggregated int, force bool) (*snapshot, error) {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+	return s.publishLocked(roas, aggregated, force)
+}
+
+// publishLocked is publish with publishMutex already held. VRPs which expire
+// before the end of the current expiryWindow are never published.
+func (s *CacheServer) publishLocked(roas vrpSet, aggregated int, force bool) (*snapshot, error) {
+	roas, expired := roas.unexpired(expiryCutoff(time.Now()))
+	if expired > 0 {
+		log.Printf("Dropped %d expired ROAs\n", expired)
+	}
+	cur := s.current.Load()
+	next := cur.next(roas)
+	next.aggregated = aggregated
+	if !force {
+		if err := s.thresholds.check(cur, next); err != nil {
+			s.quarantine = &quarantined{
+				vrps:       roas,
+				aggregated: aggregated,
+				since:      time.Now(),
+				reason:     err.Error(),
+				adds:       len(next.diff.addRoa),
+				dels:       len(next.diff.delRoa),
+			}
+			return nil, fmt.Errorf("update quarantined: %w", err)
 		}
 	}
+	if s.quarantine != nil {
+		log.Printf("Clearing quarantined update from %v\n", s.quarantine.since.Format("2006-01-02 15:04:05"))
+		s.quarantine = nil
+	}
+
+	s.current.Store(next)
+	log.Printf("roas updated, serial is now %d\n", next.serial)
+	// Expiry times can change without a diff, so always save.
+	if len(s.sources) > 0 {
+		s.saveState(next)
+	}
+	select {
+	case s.published <- struct{}{}:
+	default:
+	}
+
+	s.mutex.Lock()
+	if next.diff.diff {
+		s.updates.lastUpdate = time.Now()
+	}
+	clients := slices.Clone(s.clients)
+	s.mutex.Unlock()
+
+	// Notify all clients that the serial number has been updated.
+	for _, c := range clients {
+		log.Printf("sending a notify to %s\n", c.addr)
+		c.notify(next.serial, next.session)
+	}
+	return next, nil
 }
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Kinds of SLURM entry, named as in RFC 8416.
+const (
+	prefixFilter    = "prefixFilter"
+	bgpsecFilter    = "bgpsecFilter"
+	prefixAssertion = "prefixAssertion"
+	bgpsecAssertion = "bgpsecAssertion"
+)
+
+// slurmEntry is a single filter or assertion from a SLURM file.
+type slurmEntry struct {
+	kind string
+	file string
+	// prefix is invalid if a filter doesn't have one, as is asn with anyASN.
+	prefix    netip.Prefix
+	asn       uint32
+	anyASN    bool
+	maxLength uint8
+	ski       string
+	comment   string
+	// matched is how many VRPs a filter removed from the last update. For
+	// an assertion, it's 1 if the VRP was already validated.
+	matched int
+}
+
+// slurm is the local exceptions from RFC 8416 SLURM files. Filters drop
+// validated VRPs and assertions add VRPs of their own, in that order. The
+// files are reloaded whenever they change, and a broken file leaves the
+// previous exceptions in place.
+type slurm struct {
+	paths []string
+	// roots are the directories of paths, opened before dropping privileges.
+	roots []*os.Root
+
+	mutex   sync.Mutex
+	entries []slurmEntry
+	// stats are the files as last read, whether or not they were valid.
+	stats    []slurmStat
+	loaded   time.Time
+	err      error
+	filtered int
+	asserted int
+}
+
+type slurmStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// slurmStatus is a copy of everything in slurm that changes.
+type slurmStatus struct {
+	paths    []string
+	entries  []slurmEntry
+	loaded   time.Time
+	err      error
+	filtered int
+	asserted int
+}
+
+// slurmJSON is the format of a SLURM file. Every kind of entry shares one
+// struct, and fields which don't belong are rejected when checking them.
+type slurmJSON struct {
+	Version *int `json:"slurmVersion"`
+	Filters *struct {
+		Prefix []slurmJSONEntry `json:"prefixFilters"`
+		BGPsec []slurmJSONEntry `json:"bgpsecFilters"`
+	} `json:"validationOutputFilters"`
+	Assertions *struct {
+		Prefix []slurmJSONEntry `json:"prefixAssertions"`
+		BGPsec []slurmJSONEntry `json:"bgpsecAssertions"`
+	} `json:"locallyAddedAssertions"`
+}
+
+type slurmJSONEntry struct {
+	Prefix    *string `json:"prefix"`
+	ASN       *uint32 `json:"asn"`
+	MaxLength *int    `json:"maxPrefixLength"`
+	SKI       *string `json:"SKI"`
+	PublicKey *string `json:"routerPublicKey"`
+	Comment   string  `json:"comment"`
+}
+
+// newSLURM returns the exceptions from paths, which are read by reload. It's
+// nil with no paths.
+func newSLURM(paths []string) *slurm {
+	if len(paths) == 0 {
+		return nil
+	}
+	return &slurm{paths: paths}
+}
+
+// open opens the directory of each file. Like the state file, this is done
+// before dropping privileges so the paths are outside of any chroot.
+func (sl *slurm) open() error {
+	if sl == nil || sl.roots != nil {
+		return nil
+	}
+	roots := make([]*os.Root, len(sl.paths))
+	for i, path := range sl.paths {
+		root, err := os.OpenRoot(filepath.Dir(path))
+		if err != nil {
+			for _, r := range roots[:i] {
+				r.Close()
+			}
+			return fmt.Errorf("unable to open SLURM directory: %w", err)
+		}
+		roots[i] = root
+	}
+	sl.roots = roots
+	return nil
+}
+
+// reload reads the files again if any have changed since they were last
+// read, returning true if there are new exceptions.
+func (sl *slurm) reload() (bool, error) {
+	if sl == nil {
+		return false, nil
+	}
+	if err := sl.open(); err != nil {
+		return false, sl.failed(nil, err)
+	}
+	stats := make([]slurmStat, len(sl.paths))
+	for i, path := range sl.paths {
+		fi, err := sl.roots[i].Stat(filepath.Base(path))
+		if err != nil {
+			return false, sl.failed(nil, err)
+		}
+		stats[i] = slurmStat{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	sl.mutex.Lock()
+	unchanged := slices.Equal(stats, sl.stats)
+	sl.mutex.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	var entries []slurmEntry
+	for i, path := range sl.paths {
+		b, err := sl.roots[i].ReadFile(filepath.Base(path))
+		if err != nil {
+			return false, sl.failed(stats, err)
+		}
+		file, err := decodeSLURM(b, path)
+		if err != nil {
+			return false, sl.failed(stats, fmt.Errorf("%s: %w", path, err))
+		}
+		entries = append(entries, file...)
+	}
+	if err := checkSLURMOverlaps(entries); err != nil {
+		return false, sl.failed(stats, err)
+	}
+
+	var bgpsec int
+	for _, e := range entries {
+		if e.kind == bgpsecFilter || e.kind == bgpsecAssertion {
+			bgpsec++
+		}
+	}
+	if bgpsec > 0 {
+		log.Printf("%d SLURM BGPsec entries have no effect, as router keys aren't served\n", bgpsec)
+	}
+	log.Printf("Loaded %d SLURM entries from %d files\n", len(entries), len(sl.paths))
+
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	sl.entries = entries
+	sl.stats = stats
+	sl.loaded = time.Now()
+	sl.err = nil
+	return true, nil
+}
+
+// failed records err, along with the stats of the files that caused it so
+// they aren't read again until they change.
+func (sl *slurm) failed(stats []slurmStat, err error) error {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	if stats != nil {
+		sl.stats = stats
+	}
+	sl.err = err
+	return err
+}
+
+// decodeSLURM reads a single SLURM file.
+func decodeSLURM(b []byte, path string) ([]slurmEntry, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var f slurmJSON
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Version == nil || *f.Version != 1 {
+		return nil, errors.New("slurmVersion needs to be 1")
+	}
+	if f.Filters == nil || f.Assertions == nil {
+		return nil, errors.New("validationOutputFilters and locallyAddedAssertions are both needed")
+	}
+
+	var entries []slurmEntry
+	for _, list := range []struct {
+		kind    string
+		entries []slurmJSONEntry
+	}{
+		{prefixFilter, f.Filters.Prefix},
+		{bgpsecFilter, f.Filters.BGPsec},
+		{prefixAssertion, f.Assertions.Prefix},
+		{bgpsecAssertion, f.Assertions.BGPsec},
+	} {
+		for i, j := range list.entries {
+			e, err := j.entry(list.kind)
+			if err != nil {
+				return nil, fmt.Errorf("%s %d: %w", list.kind, i+1, err)
+			}
+			e.file = path
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// entry checks j has the fields kind needs, and only those.
+func (j slurmJSONEntry) entry(kind string) (slurmEntry, error) {
+	e := slurmEntry{kind: kind, comment: j.Comment}
+	isPrefix := kind == prefixFilter || kind == prefixAssertion
+	isFilter := kind == prefixFilter || kind == bgpsecFilter
+
+	switch {
+	case j.Prefix != nil && !isPrefix:
+		return e, errors.New("prefix isn't allowed")
+	case j.MaxLength != nil && kind != prefixAssertion:
+		return e, errors.New("maxPrefixLength isn't allowed")
+	case j.SKI != nil && isPrefix:
+		return e, errors.New("SKI isn't allowed")
+	case j.PublicKey != nil && kind != bgpsecAssertion:
+		return e, errors.New("routerPublicKey isn't allowed")
+	}
+
+	if j.ASN != nil {
+		e.asn = *j.ASN
+	} else if isFilter {
+		e.anyASN = true
+	} else {
+		return e, errors.New("asn is needed")
+	}
+
+	if j.Prefix != nil {
+		p, err := netip.ParsePrefix(*j.Prefix)
+		if err != nil {
+			return e, err
+		}
+		if p != p.Masked() {
+			return e, fmt.Errorf("%s has bits set beyond its length", p)
+		}
+		e.prefix = p
+	} else if kind == prefixAssertion {
+		return e, errors.New("prefix is needed")
+	}
+
+	if kind == prefixAssertion {
+		e.maxLength = uint8(e.prefix.Bits())
+		if j.MaxLength != nil {
+			if *j.MaxLength < e.prefix.Bits() || *j.MaxLength > e.prefix.Addr().BitLen() {
+				return e, fmt.Errorf("maxPrefixLength %d is out of range for %s", *j.MaxLength, e.prefix)
+			}
+			e.maxLength = uint8(*j.MaxLength)
+		}
+	}
+
+	if j.SKI != nil {
+		ski, err := base64.RawURLEncoding.DecodeString(*j.SKI)
+		if err != nil || len(ski) != 20 {
+			return e, fmt.Errorf("SKI %q isn't 20 bytes of base64url", *j.SKI)
+		}
+		e.ski = *j.SKI
+	} else if kind == bgpsecAssertion {
+		return e, errors.New("SKI is needed")
+	}
+	if kind == bgpsecAssertion {
+		if j.PublicKey == nil || *j.PublicKey == "" {
+			return e, errors.New("routerPublicKey is needed")
+		}
+		if _, err := base64.RawURLEncoding.DecodeString(*j.PublicKey); err != nil {
+			return e, fmt.Errorf("routerPublicKey isn't base64url: %v", err)
+		}
+	}
+
+	if isFilter && !e.prefix.IsValid() && e.anyASN && e.ski == "" {
+		return e, errors.New("a filter needs something to match")
+	}
+	return e, nil
+}
+
+// checkSLURMOverlaps rejects files which overlap each other (RFC 8416
+// section 4.2), as it's then unclear which is meant to apply.
+func checkSLURMOverlaps(entries []slurmEntry) error {
+	for i, a := range entries {
+		for _, b := range entries[i+1:] {
+			if a.file == b.file {
+				continue
+			}
+			if a.prefix.IsValid() && b.prefix.IsValid() && a.prefix.Overlaps(b.prefix) {
+				return fmt.Errorf("%s in %s overlaps %s in %s", a.prefix, a.file, b.prefix, b.file)
+			}
+			isBGPsec := func(e slurmEntry) bool { return e.kind == bgpsecFilter || e.kind == bgpsecAssertion }
+			if isBGPsec(a) && isBGPsec(b) && !a.anyASN && !b.anyASN && a.asn == b.asn {
+				return fmt.Errorf("AS%d is in both %s and %s", a.asn, a.file, b.file)
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether a prefix filter applies to r.
+func (e *slurmEntry) matches(r roa) bool {
+	if !e.anyASN && e.asn != r.ASN {
+		return false
+	}
+	return !e.prefix.IsValid() || (e.prefix.Bits() <= r.Prefix.Bits() && e.prefix.Contains(r.Prefix.Addr()))
+}
+
+// apply returns s with the filters and assertions applied. s isn't changed.
+func (sl *slurm) apply(s vrpSet) vrpSet {
+	if sl == nil {
+		return s
+	}
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	var filters, assertions []*slurmEntry
+	for i := range sl.entries {
+		e := &sl.entries[i]
+		e.matched = 0
+		switch e.kind {
+		case prefixFilter:
+			filters = append(filters, e)
+		case prefixAssertion:
+			assertions = append(assertions, e)
+		}
+	}
+
+	var out vrpSet
+	out.v4 = make([]vrp4, 0, len(s.v4)+len(assertions))
+	out.v6 = make([]vrp6, 0, len(s.v6)+len(assertions))
+	var filtered int
+	for r := range s.all() {
+		var drop bool
+		for _, e := range filters {
+			if e.matches(r) {
+				e.matched++
+				drop = true
+			}
+		}
+		if drop {
+			filtered++
+			continue
+		}
+		out.add(r)
+	}
+
+	if len(assertions) > 0 {
+		have := make(map[roa]bool)
+		for r := range out.all() {
+			have[roa{Prefix: r.Prefix, MaxMask: r.MaxMask, ASN: r.ASN}] = true
+		}
+		for _, e := range assertions {
+			r := roa{Prefix: e.prefix, MaxMask: e.maxLength, ASN: e.asn}
+			if have[r] {
+				e.matched = 1
+			}
+			out.add(r)
+		}
+		// Assertions never expire, so one that's already validated keeps
+		// that VRP for good.
+		out.normalize()
+	}
+	sl.filtered, sl.asserted = filtered, len(assertions)
+	return out
+}
+
+// status returns a copy of the current exceptions and how they matched.
+func (sl *slurm) status() *slurmStatus {
+	if sl == nil {
+		return nil
+	}
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	return &slurmStatus{
+		paths:    sl.paths,
+		entries:  slices.Clone(sl.entries),
+		loaded:   sl.loaded,
+		err:      sl.err,
+		filtered: sl.filtered,
+		asserted: sl.asserted,
+	}
+}
+
+// String describes what e matches or asserts.
+func (e slurmEntry) String() string {
+	var s string
+	if e.prefix.IsValid() {
+		s = e.prefix.String()
+		if e.kind == prefixAssertion && int(e.maxLength) != e.prefix.Bits() {
+			s += fmt.Sprintf("-%d", e.maxLength)
+		}
+		s += " "
+	}
+	if e.anyASN {
+		s += "any AS"
+	} else {
+		s += fmt.Sprintf("AS%d", e.asn)
+	}
+	if e.ski != "" {
+		s += " SKI " + e.ski
+	}
+	if e.comment != "" {
+		s += fmt.Sprintf(" (%s)", e.comment)
+	}
+	return s
+}
+
+func (s *CacheServer) slurmHandler(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		Kind      string `json:"kind"`
+		File      string `json:"file"`
+		Prefix    string `json:"prefix,omitempty"`
+		ASN       *int64 `json:"asn,omitempty"`
+		MaxLength int    `json:"maxPrefixLength,omitempty"`
+		SKI       string `json:"SKI,omitempty"`
+		Comment   string `json:"comment,omitempty"`
+		Matched   int    `json:"matched"`
+	}
+	out := struct {
+		Files    []string  `json:"files"`
+		Loaded   time.Time `json:"loaded,omitzero"`
+		Error    string    `json:"error,omitempty"`
+		Filtered int       `json:"filtered"`
+		Asserted int       `json:"asserted"`
+		Entries  []entry   `json:"entries"`
+	}{Files: []string{}, Entries: []entry{}}
+	if st := s.slurm.status(); st != nil {
+		out.Files = st.paths
+		out.Loaded = st.loaded
+		if st.err != nil {
+			out.Error = st.err.Error()
+		}
+		out.Filtered, out.Asserted = st.filtered, st.asserted
+		for _, e := range st.entries {
+			j := entry{Kind: e.kind, File: e.file, MaxLength: int(e.maxLength), SKI: e.ski, Comment: e.comment, Matched: e.matched}
+			if e.prefix.IsValid() {
+				j.Prefix = e.prefix.String()
+			}
+			if !e.anyASN {
+				asn := int64(e.asn)
+				j.ASN = &asn
+			}
+			out.Entries = append(out.Entries, j)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("unable to write slurm response: %v\n", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// slurmJSONFile returns a SLURM file with the given prefix filters and
+// assertions, which are JSON objects.
+func slurmJSONFile(filters, assertions string) string {
+	return `{
+  "slurmVersion": 1,
+  "validationOutputFilters": {"prefixFilters": [` + filters + `], "bgpsecFilters": []},
+  "locallyAddedAssertions": {"prefixAssertions": [` + assertions + `], "bgpsecAssertions": []}
+}`
+}
+
+func loadSLURM(t *testing.T, files ...string) *slurm {
+	t.Helper()
+	var paths []string
+	for i, f := range files {
+		path := filepath.Join(t.TempDir(), string(rune('a'+i))+".json")
+		writeFile(t, path, f)
+		paths = append(paths, path)
+	}
+	sl := newSLURM(paths)
+	if _, err := sl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	return sl
+}
+
+func TestSLURMApply(t *testing.T) {
+	a := roa{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxMask: 24, ASN: 64496, Expires: 1800000000}
+	b := roa{Prefix: netip.MustParsePrefix("192.0.2.128/25"), MaxMask: 25, ASN: 64497}
+	c := roa{Prefix: netip.MustParsePrefix("198.51.100.0/24"), MaxMask: 24, ASN: 64497}
+	d := roa{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 64498}
+	input := newVRPSet([]roa{a, b, c, d})
+
+	sl := loadSLURM(t, slurmJSONFile(
+		`{"prefix": "192.0.2.0/24", "comment": "Everything in 192.0.2.0/24"},
+		 {"asn": 64497},
+		 {"prefix": "2001:db8::/32", "asn": 64499}`,
+		`{"asn": 64496, "prefix": "192.0.2.0/24", "maxPrefixLength": 24},
+		 {"asn": 64500, "prefix": "2001:db8:1::/48", "maxPrefixLength": 56, "comment": "Broken ROA"}`,
+	))
+	got := sl.apply(input)
+
+	// The filtered VRP a is asserted again, and never expires now.
+	want := newVRPSet([]roa{
+		{Prefix: a.Prefix, MaxMask: 24, ASN: 64496},
+		d,
+		{Prefix: netip.MustParsePrefix("2001:db8:1::/48"), MaxMask: 56, ASN: 64500},
+	})
+	if !reflect.DeepEqual(got.roas(), want.roas()) {
+		t.Errorf("Got %v, Want %v", got.roas(), want.roas())
+	}
+	if input.len() != 4 {
+		t.Errorf("Input was changed to %v", input.roas())
+	}
+
+	st := sl.status()
+	var matched []int
+	for _, e := range st.entries {
+		matched = append(matched, e.matched)
+	}
+	// b matches both of the first filters.
+	if wantMatched := []int{2, 2, 0, 0, 0}; !reflect.DeepEqual(matched, wantMatched) {
+		t.Errorf("Got matches %v, Want %v", matched, wantMatched)
+	}
+	if st.filtered != 3 || st.asserted != 2 {
+		t.Errorf("Got %d filtered and %d asserted, Want 3 and 2", st.filtered, st.asserted)
+	}
+
+	// An assertion of a VRP that's already there is counted as matched.
+	sl = loadSLURM(t, slurmJSONFile("", `{"asn": 64498, "prefix": "2001:db8::/32", "maxPrefixLength": 48}`))
+	if got := sl.apply(input); got.len() != 4 {
+		t.Errorf("Got %v, Want the input unchanged", got.roas())
+	}
+	if e := sl.status().entries[0]; e.matched != 1 {
+		t.Errorf("Assertion of an existing VRP matched %d", e.matched)
+	}
+}
+
+func TestDecodeSLURM(t *testing.T) {
+	ski := `"SKI": "Zm9vYmFyYmF6cXV4Zm9vYmFyYmE"`
+	good := `{
+  "slurmVersion": 1,
+  "validationOutputFilters": {
+    "prefixFilters": [{"prefix": "10.0.0.0/8", "comment": "All VRPs encompassed by prefix"}],
+    "bgpsecFilters": [{"asn": 64496, "comment": "All keys for ASN"}, {` + ski + `}]
+  },
+  "locallyAddedAssertions": {
+    "prefixAssertions": [{"asn": 64496, "prefix": "198.51.100.0/24"}],
+    "bgpsecAssertions": [{"asn": 64496, ` + ski + `, "routerPublicKey": "dGVzdA"}]
+  }
+}`
+	entries, err := decodeSLURM([]byte(good), "good.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, e := range entries {
+		kinds = append(kinds, e.kind)
+	}
+	if want := []string{prefixFilter, bgpsecFilter, bgpsecFilter, prefixAssertion, bgpsecAssertion}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("Got %v, Want %v", kinds, want)
+	}
+	if e := entries[3]; e.maxLength != 24 {
+		t.Errorf("Assertion without maxPrefixLength has %d, Want 24", e.maxLength)
+	}
+
+	for _, bad := range []struct {
+		desc string
+		file string
+	}{
+		{"version 2", strings.Replace(slurmJSONFile("", ""), `"slurmVersion": 1`, `"slurmVersion": 2`, 1)},
+		{"no assertions", `{"slurmVersion": 1, "validationOutputFilters": {}}`},
+		{"empty filter", slurmJSONFile(`{"comment": "nothing"}`, "")},
+		{"host bits", slurmJSONFile(`{"prefix": "192.0.2.1/24"}`, "")},
+		{"filter with maxPrefixLength", slurmJSONFile(`{"prefix": "192.0.2.0/24", "maxPrefixLength": 24}`, "")},
+		{"assertion without asn", slurmJSONFile("", `{"prefix": "192.0.2.0/24"}`)},
+		{"assertion without prefix", slurmJSONFile("", `{"asn": 64496}`)},
+		{"maxPrefixLength too short", slurmJSONFile("", `{"asn": 64496, "prefix": "192.0.2.0/24", "maxPrefixLength": 23}`)},
+		{"maxPrefixLength too long", slurmJSONFile("", `{"asn": 64496, "prefix": "192.0.2.0/24", "maxPrefixLength": 33}`)},
+		{"asn too large", slurmJSONFile(`{"asn": 4294967296}`, "")},
+		{"short SKI", `{"slurmVersion": 1, "validationOutputFilters": {"bgpsecFilters": [{"SKI": "dGVzdA"}]}, "locallyAddedAssertions": {}}`},
+		{"not json", "slurmVersion = 1"},
+	} {
+		if _, err := decodeSLURM([]byte(bad.file), "bad.json"); err == nil {
+			t.Errorf("%s: no error", bad.desc)
+		}
+	}
+}
+
+func TestSLURMReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "slurm.json")
+	writeFile(t, path, slurmJSONFile(`{"asn": 64496}`, ""))
+	sl := newSLURM([]string{path})
+	if changed, err := sl.reload(); !changed || err != nil {
+		t.Fatalf("First load returned %t, %v", changed, err)
+	}
+	if changed, err := sl.reload(); changed || err != nil {
+		t.Errorf("Unchanged file returned %t, %v", changed, err)
+	}
+
+	// A broken file keeps the previous entries, and is only reported once.
+	writeFile(t, path, `{"slurmVersion": 1,`)
+	if changed, err := sl.reload(); changed || err == nil {
+		t.Errorf("Broken file returned %t, %v", changed, err)
+	}
+	if changed, err := sl.reload(); changed || err != nil {
+		t.Errorf("Broken file read again returned %t, %v", changed, err)
+	}
+	if st := sl.status(); len(st.entries) != 1 || st.err == nil {
+		t.Errorf("Got %d entries and error %v, Want the previous entry and an error", len(st.entries), st.err)
+	}
+
+	writeFile(t, path, slurmJSONFile(`{"asn": 64496}, {"asn": 64497}`, ""))
+	if changed, err := sl.reload(); !changed || err != nil {
+		t.Errorf("Fixed file returned %t, %v", changed, err)
+	}
+	if st := sl.status(); len(st.entries) != 2 || st.err != nil {
+		t.Errorf("Got %d entries and error %v, Want 2 and no error", len(st.entries), st.err)
+	}
+
+	// Files can't overlap each other.
+	other := filepath.Join(dir, "other.json")
+	writeFile(t, path, slurmJSONFile(`{"prefix": "192.0.2.0/24"}`, ""))
+	writeFile(t, other, slurmJSONFile("", `{"asn": 64496, "prefix": "192.0.2.128/25"}`))
+	if _, err := newSLURM([]string{path, other}).reload(); err == nil {
+		t.Errorf("Overlapping files were loaded")
+	}
+}
+
+func TestRefreshSLURM(t *testing.T) {
+	dir := t.TempDir()
+	feed := filepath.Join(dir, "vrps.json")
+	writeFile(t, feed, vrpJSON("192.0.2.0/24", "198.51.100.0/24"))
+	path := filepath.Join(dir, "slurm.json")
+	writeFile(t, path, slurmJSONFile("", ""))
+
+	s := &CacheServer{
+		mutex:   &sync.RWMutex{},
+		sources: newSources([]sourceConfig{{url: "file://" + feed}}),
+		slurm:   newSLURM([]string{path}),
+	}
+	s.current.Store(newSnapshot(vrpSet{}, 0, 1, serialDiff{}))
+	ch := make(chan bool, 1)
+	refresh := func(want ...string) {
+		t.Helper()
+		s.refresh(ch, true)
+		select {
+		case <-ch:
+		default:
+		}
+		var got []string
+		for r := range s.current.Load().vrps.all() {
+			got = append(got, r.Prefix.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %v, Want %v", got, want)
+		}
+	}
+	refresh("192.0.2.0/24", "198.51.100.0/24")
+
+	// Only the SLURM file has changed, so the same VRPs are used again.
+	writeFile(t, path, slurmJSONFile(`{"prefix": "198.51.100.0/24"}`, `{"asn": 64496, "prefix": "203.0.113.0/24"}`))
+	refresh("192.0.2.0/24", "203.0.113.0/24")
+	if serial := s.current.Load().serial; serial != 2 {
+		t.Errorf("Got serial %d, Want 2", serial)
+	}
+
+	// Nothing changed, so nothing is published.
+	refresh("192.0.2.0/24", "203.0.113.0/24")
+	if serial := s.current.Load().serial; serial != 2 {
+		t.Errorf("Got serial %d, Want 2", serial)
+	}
+
+	// A SLURM change is applied even when the sources can't be fetched.
+	writeFile(t, feed, `{"roas": [`)
+	writeFile(t, path, slurmJSONFile(`{"prefix": "192.0.2.0/24"}`, ""))
+	refresh("198.51.100.0/24")
+
+	// Started from the state file, the published VRPs are used.
+	s.validated, s.haveValidated = vrpSet{}, false
+	writeFile(t, path, slurmJSONFile(`{"prefix": "192.0.2.0/24"}, {"prefix": "198.51.100.0/24"}`, `{"asn": 64496, "prefix": "203.0.113.0/24"}`))
+	refresh("203.0.113.0/24")
+}
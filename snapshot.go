@@ -0,0 +1,49 @@
+package main
+
+import "sync"
+
+// snapshot is everything served for a single serial. Once published it is
+// never modified, so a response built from one snapshot is always consistent
+// and no lock is needed while writing it out.
+type snapshot struct {
+	vrps    vrpSet
+	serial  uint32
+	session uint16
+	diff    serialDiff
+	pdus    *pduCache
+	// VRPs removed by aggregation before publishing.
+	aggregated int
+
+	// The prefix index is only built if something needs it.
+	indexOnce sync.Once
+	idx       *vrpIndex
+}
+
+func newSnapshot(vrps vrpSet, serial uint32, session uint16, diff serialDiff) *snapshot {
+	return &snapshot{
+		vrps:    vrps,
+		serial:  serial,
+		session: session,
+		diff:    diff,
+		pdus:    newPDUCache(),
+	}
+}
+
+// next returns a snapshot for the following serial.
+func (s *snapshot) next(vrps vrpSet) *snapshot {
+	return newSnapshot(vrps, s.serial+1, s.session, makeDiff(vrps, s.vrps, s.serial))
+}
+
+// hasDiff reports whether the snapshot holds the diff from the serial before
+// it. Snapshots not made by next, like one loaded from the state file, don't.
+func (s *snapshot) hasDiff() bool {
+	return s.diff.oldSerial == s.serial-1 && s.diff.newSerial == s.serial
+}
+
+// index returns the prefix index over the snapshot's VRPs.
+func (s *snapshot) index() *vrpIndex {
+	s.indexOnce.Do(func() {
+		s.idx = newVRPIndex(s.vrps)
+	})
+	return s.idx
+}
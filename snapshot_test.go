@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshotNext(t *testing.T) {
+	one := roa{Prefix: netip.MustParsePrefix("192.168.1.0/24"), MaxMask: 24, ASN: 123}
+	two := roa{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 123}
+
+	first := newSnapshot(newVRPSet([]roa{one}), 5, 10, serialDiff{})
+	second := first.next(newVRPSet([]roa{one, two}))
+
+	if second.serial != 6 || second.session != 10 {
+		t.Errorf("Got serial %d session %d, Want serial 6 session 10", second.serial, second.session)
+	}
+	if !second.diff.diff || len(second.diff.addRoa) != 1 || second.diff.addRoa[0] != two {
+		t.Errorf("Unexpected diff %#v", second.diff)
+	}
+	if second.diff.oldSerial != 5 || second.diff.newSerial != 6 {
+		t.Errorf("Diff goes from %d to %d, Want 5 to 6", second.diff.oldSerial, second.diff.newSerial)
+	}
+
+	// The earlier snapshot is left as it was.
+	if first.serial != 5 || first.vrps.len() != 1 {
+		t.Errorf("Previous snapshot was modified: %#v", first)
+	}
+	if second.pdus == first.pdus {
+		t.Errorf("Snapshots share encoded PDUs")
+	}
+	if first.hasDiff() || !second.hasDiff() {
+		t.Errorf("Got hasDiff %t and %t, Want only the second to have a diff", first.hasDiff(), second.hasDiff())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Now().Unix()
+	keep := roa{Prefix: netip.MustParsePrefix("192.168.1.0/24"), MaxMask: 24, ASN: 123, Expires: now + 3600}
+	gone := roa{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 123, Expires: now + 1}
+	s := &CacheServer{
+		mutex:      &sync.RWMutex{},
+		published:  make(chan struct{}, 1),
+		thresholds: thresholds{minVRPs: 1, maxWithdraw: 10},
+	}
+	s.current.Store(newSnapshot(newVRPSet([]roa{keep, gone}), 1, 1, serialDiff{}))
+	q := &quarantined{reason: "testing"}
+	s.quarantine = q
+
+	ch := make(chan bool, 1)
+	go s.expireROAs(ch)
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing expired")
+	}
+
+	// Withdrawing half the VRPs breaks max_withdraw, but expiry isn't held
+	// back, and doesn't touch what's quarantined.
+	got := s.current.Load()
+	if got.serial != 2 || got.vrps.len() != 1 || len(got.diff.delRoa) != 1 || got.diff.delRoa[0] != gone {
+		t.Errorf("Got serial %d with %d VRPs and diff %+v, Want serial 2 withdrawing %v", got.serial, got.vrps.len(), got.diff, gone)
+	}
+	if s.quarantineStatus() != q {
+		t.Errorf("Expiry changed the quarantine")
+	}
+}
+
+func TestExpireBatched(t *testing.T) {
+	// Both expire in the same window, a few seconds apart.
+	cutoff := expiryCutoff(time.Now()).Unix()
+	keep := roa{Prefix: netip.MustParsePrefix("192.168.1.0/24"), MaxMask: 24, ASN: 123, Expires: cutoff + 3600}
+	first := roa{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 123, Expires: cutoff - 4}
+	second := roa{Prefix: netip.MustParsePrefix("2001:db8:1::/48"), MaxMask: 48, ASN: 123, Expires: cutoff - 1}
+	s := &CacheServer{
+		mutex:     &sync.RWMutex{},
+		published: make(chan struct{}, 1),
+	}
+	s.current.Store(newSnapshot(newVRPSet([]roa{keep, first, second}), 1, 1, serialDiff{}))
+
+	ch := make(chan bool, 2)
+	go s.expireROAs(ch)
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing expired")
+	}
+	select {
+	case <-ch:
+		t.Errorf("Expired twice")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if got := s.current.Load(); got.serial != 2 || got.vrps.len() != 1 || len(got.diff.delRoa) != 2 {
+		t.Errorf("Got serial %d with %d VRPs and diff %+v, Want serial 2 withdrawing both", got.serial, got.vrps.len(), got.diff)
+	}
+}
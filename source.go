@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// source is a single VRP feed. The validators from the last good response are
+// kept along with its VRPs, so an unchanged feed isn't downloaded again.
+// Only readROAs fetches, one goroutine per source, but status and the last
+// VRPs are read by anything. The fetching goroutine writes to the fields
+// under mutex and is the only writer, so it reads them without it.
+type source struct {
+	sourceConfig
+	etag         string
+	lastModified string
+	vrps         vrpSet
+	meta         metadata
+	// Local files last read, for file:// sources, and the directory they're
+	// read from.
+	files    map[string]fileState
+	root     *os.Root
+	rootName string
+	// The upstream cache for rtr:// and rtrs:// sources, and its update
+	// count when last fetched.
+	rtr        *rtrClient
+	rtrVersion int
+
+	mutex  sync.Mutex
+	status sourceStatus
+}
+
+// sourceStatus is the outcome of the latest fetches of a source.
+type sourceStatus struct {
+	lastSuccess time.Time
+	lastError   time.Time
+	err         error
+	// How long the last fetch took, including retries.
+	duration time.Duration
+	vrps     int
+	// How this source differed from what was last published. rejected VRPs
+	// were left out by the merge policy, and missing ones published without
+	// this source having them.
+	rejected int
+	missing  int
+	// meta is from the last successful fetch, and stale is why it's too old.
+	meta  metadata
+	stale error
+}
+
+const (
+	retryBase = time.Second
+	retryMax  = 30 * time.Second
+)
+
+// errStatus is an unexpected HTTP status from a source.
+type errStatus int
+
+func (e errStatus) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", int(e), http.StatusText(int(e)))
+}
+
+var errTooLarge = errors.New("response is larger than max_size")
+
+func newSources(cfgs []sourceConfig) []*source {
+	sources := make([]*source, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.name == "" {
+			cfg.name = cfg.url
+		}
+		if cfg.timeout == 0 {
+			cfg.timeout = defaultFetchTimeout
+		}
+		if cfg.maxSize == 0 {
+			cfg.maxSize = defaultMaxSize
+		}
+		src := &source{sourceConfig: cfg}
+		if u, err := url.Parse(cfg.url); err == nil && (u.Scheme == "rtr" || u.Scheme == "rtrs") {
+			src.rtr = newRTRClient(u, cfg.timeout, cfg.roots)
+		}
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// sourceURLs returns the url of each source.
+func sourceURLs(sources []*source) []string {
+	urls := make([]string, 0, len(sources))
+	for _, src := range sources {
+		urls = append(urls, src.url)
+	}
+	return urls
+}
+
+// fetch returns the VRPs from the source, normalized. If the feed hasn't
+// changed since the last fetch the previous VRPs are returned with false.
+// Failures are retried with a jittered exponential backoff.
+func (src *source) fetch() (vrpSet, bool, error) {
+	start := time.Now()
+	var vrps vrpSet
+	var changed bool
+	var err error
+	for attempt := 0; ; attempt++ {
+		vrps, changed, err = src.fetchOnce()
+		if err == nil || attempt >= src.retries || !retryable(err) {
+			break
+		}
+		wait := backoff(attempt)
+		log.Printf("unable to retrieve ROAs from %s, retrying in %v: %v\n", src.name, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+	}
+
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	src.status.duration = time.Since(start)
+	if err == nil {
+		// A source that failed last time has to be merged in again, even if
+		// it hasn't changed since.
+		changed = changed || src.status.err != nil
+		src.status.meta = src.meta
+		src.status.stale = src.meta.checkAge(src.maxAge, time.Now())
+		if src.status.stale != nil {
+			if src.alertStale {
+				log.Printf("ALERT: %s is stale: %v\n", src.name, src.status.stale)
+			} else {
+				err = src.status.stale
+			}
+		}
+	}
+	src.status.err = err
+	if err != nil {
+		src.status.lastError = time.Now()
+		return vrpSet{}, false, err
+	}
+	src.status.lastSuccess = time.Now()
+	src.status.vrps = vrps.len()
+	return vrps, changed, nil
+}
+
+// watched reports whether the source triggers its own refreshes when it
+// changes, which file:// sources and upstream RTR caches do.
+func (src *source) watched() bool {
+	_, ok := src.filePath()
+	return ok || src.rtr != nil
+}
+
+// previous returns what the last fetch returned, without fetching again.
+func (src *source) previous() (vrpSet, error) {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	if src.status.err != nil {
+		return vrpSet{}, src.status.err
+	}
+	if src.status.lastSuccess.IsZero() {
+		return vrpSet{}, errors.New("not fetched yet")
+	}
+	return src.vrps, nil
+}
+
+// lastStatus returns the outcome of the latest fetches.
+func (src *source) lastStatus() sourceStatus {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	return src.status
+}
+
+// setAgreement records how the source differs from what was published.
+func (src *source) setAgreement(rejected, missing int) {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	src.status.rejected = rejected
+	src.status.missing = missing
+}
+
+// retryable is false for client errors which won't go away on their own.
+func retryable(err error) bool {
+	var status errStatus
+	if errors.As(err, &status) && status >= 400 && status < 500 {
+		return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, errTooLarge)
+}
+
+// backoff doubles for each attempt up to retryMax. Half of it is random so
+// that retries to the same server don't line up.
+func backoff(attempt int) time.Duration {
+	d := min(retryBase<<attempt, retryMax)
+	return d/2 + rand.N(d/2)
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// fetchOnce makes a single request, which must complete within the timeout.
+func (src *source) fetchOnce() (vrpSet, bool, error) {
+	if path, ok := src.filePath(); ok {
+		return src.fetchFiles(path)
+	}
+	if src.rtr != nil {
+		return src.fetchRTR()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), src.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.url, nil)
+	if err != nil {
+		return vrpSet{}, false, err
+	}
+	// Setting this ourselves turns off the transport's own gzip handling.
+	req.Header.Set("Accept-Encoding", "zstd, gzip")
+	if src.etag != "" {
+		req.Header.Set("If-None-Match", src.etag)
+	}
+	if src.lastModified != "" {
+		req.Header.Set("If-Modified-Since", src.lastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return vrpSet{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return src.vrps, false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return vrpSet{}, false, errStatus(resp.StatusCode)
+	}
+
+	// Both what's sent and what it decompresses to are limited.
+	raw := &limitReader{r: resp.Body, n: src.maxSize}
+	body, err := decompress(raw, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return vrpSet{}, false, err
+	}
+	defer body.Close()
+	vrps, meta, err := decodeFeed(body, resp.Request.URL.Path, src.format, src.maxSize)
+	if err != nil {
+		return vrpSet{}, false, err
+	}
+
+	src.mutex.Lock()
+	src.etag = resp.Header.Get("ETag")
+	src.lastModified = resp.Header.Get("Last-Modified")
+	src.vrps = vrps
+	src.meta = meta
+	src.mutex.Unlock()
+	log.Printf("Returning %d ROAs from %s\n", vrps.len(), src.name)
+	return vrps, true, nil
+}
+
+// decodeFeed returns the normalized VRPs in r, at most maxSize bytes once
+// decompressed, and the feed's metadata. An empty format is detected from the
+// data. Compressed files are often served without a Content-Encoding, so go
+// by the name. The data is checked too in case it was already decoded.
+func decodeFeed(r io.Reader, name, format string, maxSize int64) (vrpSet, metadata, error) {
+	br := bufio.NewReader(r)
+	r = br
+	name = strings.ToLower(name)
+	if magic, _ := br.Peek(4); strings.HasSuffix(name, ".gz") && bytes.HasPrefix(magic, gzipMagic) {
+		zr, err := decompress(br, "gzip")
+		if err != nil {
+			return vrpSet{}, metadata{}, err
+		}
+		defer zr.Close()
+		r = zr
+	} else if strings.HasSuffix(name, ".zst") && bytes.HasPrefix(magic, zstdMagic) {
+		zr, err := decompress(br, "zstd")
+		if err != nil {
+			return vrpSet{}, metadata{}, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	var vrps vrpSet
+	var meta metadata
+	if err := decodeFormat(&limitReader{r: r, n: maxSize}, format, &vrps, &meta); err != nil {
+		if errors.Is(err, errTooLarge) {
+			return vrpSet{}, metadata{}, err
+		}
+		return vrpSet{}, metadata{}, fmt.Errorf("unable to decode ROAs: %w", err)
+	}
+	vrps.normalize()
+	return vrps, meta, nil
+}
+
+// limitReader returns errTooLarge once more than n bytes have been read.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errTooLarge
+	}
+	return n, err
+}
+
+// decompress wraps r to undo the given content encoding.
+func decompress(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstded(t *testing.T, b []byte) []byte {
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zw.Close()
+	return zw.EncodeAll(b, nil)
+}
+
+func TestSourceFetch(t *testing.T) {
+	data, err := os.ReadFile("data/int.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want vrpSet
+	if err := decodeROAs(bytes.NewReader(data), &want, nil); err != nil {
+		t.Fatal(err)
+	}
+	want.normalize()
+
+	var requests int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plain.json", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(data)
+	})
+	mux.HandleFunc("/encoded.json", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.Header.Get("Accept-Encoding"), "zstd"):
+			w.Header().Set("Content-Encoding", "zstd")
+			w.Write(zstded(t, data))
+		default:
+			w.Write(data)
+		}
+	})
+	mux.HandleFunc("/vrps.json.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzipped(t, data))
+	})
+	mux.HandleFunc("/vrps.json.zst", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(zstded(t, data))
+	})
+	// Some servers mark compressed files with a Content-Encoding as well.
+	mux.HandleFunc("/encoded.json.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped(t, data))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, path := range []string{"/plain.json", "/encoded.json", "/vrps.json.gz", "/vrps.json.zst", "/encoded.json.gz"} {
+		src := newSources([]sourceConfig{{url: srv.URL + path}})[0]
+		got, changed, err := src.fetch()
+		if err != nil {
+			t.Errorf("Error on %s: %v", path, err)
+			continue
+		}
+		if !changed || got.len() != want.len() || !slices.Equal(got.v4, want.v4) || !slices.Equal(got.v6, want.v6) {
+			t.Errorf("Error on %s. Got %d VRPs (changed %t), Want %d", path, got.len(), changed, want.len())
+		}
+	}
+
+	// The second fetch is answered with a 304, and the same VRPs returned.
+	src := newSources([]sourceConfig{{url: srv.URL + "/plain.json"}})[0]
+	requests = 0
+	src.fetch()
+	got, changed, err := src.fetch()
+	if err != nil {
+		t.Fatalf("Error on unchanged fetch: %v", err)
+	}
+	if changed || requests != 2 || got.len() != want.len() {
+		t.Errorf("Got changed %t after %d requests with %d VRPs, Want unchanged after 2 with %d", changed, requests, got.len(), want.len())
+	}
+	set, changed, err := readROAs([]*source{src}, unionPolicy)
+	if err != nil || changed || set.len() != 0 {
+		t.Errorf("readROAs with no changes returned %d VRPs, changed %t, err %v", set.len(), changed, err)
+	}
+
+	// Refreshing only the watched sources reuses what the rest last returned.
+	feed := filepath.Join(t.TempDir(), "vrps.json")
+	writeFile(t, feed, vrpJSON("203.0.113.0/24"))
+	file := newSources([]sourceConfig{{url: "file://" + feed}})[0]
+	requests = 0
+	set, changed, err = readSources([]*source{src, file}, unionPolicy, false)
+	if err != nil || !changed || requests != 0 || set.len() != want.len()+1 {
+		t.Errorf("Watched refresh returned %d VRPs after %d requests, changed %t, err %v, Want %d after none", set.len(), requests, changed, err, want.len()+1)
+	}
+}
+
+func TestSourceFailures(t *testing.T) {
+	data, err := os.ReadFile("data/int.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flaky int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if flaky++; flaky == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(data)
+	})
+	var missing int
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		missing++
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write(data)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		desc    string
+		cfg     sourceConfig
+		wantErr bool
+	}{
+		{
+			desc: "server error is retried",
+			cfg:  sourceConfig{url: srv.URL + "/flaky", retries: 1},
+		},
+		{
+			desc:    "not found",
+			cfg:     sourceConfig{url: srv.URL + "/missing", retries: 3},
+			wantErr: true,
+		},
+		{
+			desc:    "timeout",
+			cfg:     sourceConfig{url: srv.URL + "/slow", timeout: 50 * time.Millisecond},
+			wantErr: true,
+		},
+		{
+			desc:    "too large",
+			cfg:     sourceConfig{url: srv.URL + "/large", maxSize: 100},
+			wantErr: true,
+		},
+	}
+	for _, v := range tests {
+		src := newSources([]sourceConfig{v.cfg})[0]
+		_, _, err := src.fetch()
+		if err == nil && v.wantErr {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+		if err != nil && !v.wantErr {
+			t.Errorf("Error on %s. No error expected, but error received: %v", v.desc, err)
+		}
+		st := src.lastStatus()
+		if v.wantErr && (st.err == nil || st.lastError.IsZero() || !st.lastSuccess.IsZero()) {
+			t.Errorf("Error on %s. Failure not recorded: %+v", v.desc, st)
+		}
+		if !v.wantErr && (st.err != nil || st.lastSuccess.IsZero() || st.vrps == 0) {
+			t.Errorf("Error on %s. Success not recorded: %+v", v.desc, st)
+		}
+	}
+	// A 404 won't fix itself, so isn't retried.
+	if missing != 1 {
+		t.Errorf("Not found was requested %d times, Want 1", missing)
+	}
+
+	// Nothing is better than an empty set when every source fails.
+	if _, _, err := readROAs(newSources([]sourceConfig{{url: srv.URL + "/missing"}}), unionPolicy); err == nil {
+		t.Errorf("readROAs with every source failing did not return an error")
+	}
+}
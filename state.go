@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+The state file holds a complete VRP set so the server can start without
+downloading and parsing JSON. All values are big endian.
+
+	magic    [8]byte  "RPKIRTR\x00"
+	version  uint16
+	session  uint16
+	serial   uint32
+	created  int64    unix seconds
+	sources  uint16   followed by each source as a uint16 length and string
+	tas      uint16   followed by each trust anchor the same way, in bit order
+	v4 count uint32
+	v6 count uint32
+	v4 VRPs  address [4]byte, prefix length, max length, asn uint32, expires uint32, tas uint32
+	v6 VRPs  address [16]byte, prefix length, max length, asn uint32, expires uint32, tas uint32
+	validated          the same counts and VRPs again, for the set before filters and SLURM
+	crc      uint32   CRC-32C of everything before it
+
+Version 1 files have no expires, version 2 no trust anchors and version 3 no
+validated set. All are still read.
+*/
+
+const stateVersion uint16 = 4
+
+var stateMagic = [8]byte{'R', 'P', 'K', 'I', 'R', 'T', 'R', 0}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// savedState is everything kept in the state file.
+type savedState struct {
+	session uint16
+	serial  uint32
+	created time.Time
+	sources []string
+	// vrps is what was published, validated what the sources gave before
+	// the filters, SLURM and aggregation. Before version 4 only vrps is
+	// saved, and validated is a copy of it.
+	vrps      vrpSet
+	validated vrpSet
+}
+
+// stateFile is where the current VRP set is saved. The directory is opened
+// up front, so the file can still be written after a chroot.
+type stateFile struct {
+	root *os.Root
+	name string
+	// mtime of the file when last loaded.
+	loaded time.Time
+}
+
+func openStateFile(path string) (*stateFile, error) {
+	root, err := os.OpenRoot(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open state directory: %w", err)
+	}
+	return &stateFile{
+		root: root,
+		name: filepath.Base(path),
+	}, nil
+}
+
+// load reads and checks the state file.
+func (f *stateFile) load() (savedState, error) {
+	mtime, err := f.modified()
+	if err != nil {
+		return savedState{}, err
+	}
+	b, err := f.root.ReadFile(f.name)
+	if err != nil {
+		return savedState{}, err
+	}
+	st, err := decodeState(b)
+	if err != nil {
+		return st, err
+	}
+	f.loaded = mtime
+	return st, nil
+}
+
+// modified returns the modification time of the state file.
+func (f *stateFile) modified() (time.Time, error) {
+	fi, err := f.root.Stat(f.name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// save writes to a temporary file first, then renames it over the old one.
+// Readers will only ever see a complete file.
+func (f *stateFile) save(st savedState) error {
+	tmp := fmt.Sprintf(".%s.%d.tmp", f.name, os.Getpid())
+	file, err := f.root.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = encodeState(w, st)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = f.root.Rename(tmp, f.name)
+	}
+	if err != nil {
+		f.root.Remove(tmp)
+		return err
+	}
+
+	// Make sure the rename itself is on disk.
+	if dir, err := f.root.Open("."); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// encodeState writes st in the state file format.
+func encodeState(w io.Writer, st savedState) error {
+	crc := crc32.New(crcTable)
+	w = io.MultiWriter(w, crc)
+
+	b := make([]byte, 0, 64)
+	b = append(b, stateMagic[:]...)
+	b = binary.BigEndian.AppendUint16(b, stateVersion)
+	b = binary.BigEndian.AppendUint16(b, st.session)
+	b = binary.BigEndian.AppendUint32(b, st.serial)
+	b = binary.BigEndian.AppendUint64(b, uint64(st.created.Unix()))
+	b = appendStrings(b, st.sources)
+	b = appendStrings(b, trustAnchors.all())
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if err := writeVRPs(w, st.vrps); err != nil {
+		return err
+	}
+	if err := writeVRPs(w, st.validated); err != nil {
+		return err
+	}
+
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// writeVRPs writes the v4 and v6 counts, then the VRPs.
+func writeVRPs(w io.Writer, set vrpSet) error {
+	b := make([]byte, 0, 32)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(set.v4)))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(set.v6)))
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	for _, v := range set.v4 {
+		b = append(b[:0], v.addr[:]...)
+		b = append(b, v.bits, v.max)
+		b = binary.BigEndian.AppendUint32(b, v.asn)
+		b = binary.BigEndian.AppendUint32(b, v.expires)
+		b = binary.BigEndian.AppendUint32(b, v.tas)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	for _, v := range set.v6 {
+		b = append(b[:0], v.addr[:]...)
+		b = append(b, v.bits, v.max)
+		b = binary.BigEndian.AppendUint32(b, v.asn)
+		b = binary.BigEndian.AppendUint32(b, v.expires)
+		b = binary.BigEndian.AppendUint32(b, v.tas)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendStrings appends a uint16 count, then each string with its length.
+func appendStrings(b []byte, list []string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(list)))
+	for _, s := range list {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+// readStrings reads what appendStrings wrote, returning the rest of b.
+func readStrings(b []byte) ([]string, []byte, error) {
+	if len(b) < 2 {
+		return nil, b, errStateTruncated
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	var list []string
+	for range n {
+		if len(b) < 2 {
+			return nil, b, errStateTruncated
+		}
+		l := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+l {
+			return nil, b, errStateTruncated
+		}
+		list = append(list, string(b[2:2+l]))
+		b = b[2+l:]
+	}
+	return list, b, nil
+}
+
+var errStateTruncated = errors.New("state file is truncated")
+
+// decodeState parses and checks a state file.
+func decodeState(b []byte) (savedState, error) {
+	var st savedState
+	if len(b) < len(stateMagic)+4 {
+		return st, errStateTruncated
+	}
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return st, errors.New("state file checksum mismatch")
+	}
+	if [8]byte(body[:8]) != stateMagic {
+		return st, errors.New("not a state file")
+	}
+	body = body[8:]
+
+	if len(body) < 16 {
+		return st, errStateTruncated
+	}
+	version := binary.BigEndian.Uint16(body)
+	if version < 1 || version > stateVersion {
+		return st, fmt.Errorf("unsupported state file version %d", version)
+	}
+	st.session = binary.BigEndian.Uint16(body[2:])
+	st.serial = binary.BigEndian.Uint32(body[4:])
+	st.created = time.Unix(int64(binary.BigEndian.Uint64(body[8:])), 0)
+	body = body[16:]
+	var err error
+	if st.sources, body, err = readStrings(body); err != nil {
+		return st, err
+	}
+	// Bits in the file are mapped to the bits for the same names here.
+	var tas []uint32
+	if version > 2 {
+		var names []string
+		if names, body, err = readStrings(body); err != nil {
+			return st, err
+		}
+		for _, name := range names {
+			tas = append(tas, trustAnchors.bit(name))
+		}
+	}
+	remap := func(mask uint32) uint32 {
+		var out uint32
+		for i, b := range tas {
+			if mask&(1<<i) != 0 {
+				out |= b
+			}
+		}
+		return out
+	}
+
+	if st.vrps, body, err = readVRPs(body, version, remap); err != nil {
+		return st, err
+	}
+	st.validated = st.vrps
+	if version > 3 {
+		if st.validated, body, err = readVRPs(body, version, remap); err != nil {
+			return st, err
+		}
+	}
+	if len(body) != 0 {
+		return st, errors.New("state file has trailing data")
+	}
+	return st, nil
+}
+
+// readVRPs reads what writeVRPs wrote, returning the rest of body.
+func readVRPs(body []byte, version uint16, remap func(uint32) uint32) (vrpSet, []byte, error) {
+	var set vrpSet
+	if len(body) < 8 {
+		return set, body, errStateTruncated
+	}
+	n4 := int(binary.BigEndian.Uint32(body))
+	n6 := int(binary.BigEndian.Uint32(body[4:]))
+	body = body[8:]
+	size4, size6 := 10, 22
+	switch version {
+	case 2:
+		size4, size6 = 14, 26
+	case 3, 4:
+		size4, size6 = 18, 30
+	}
+	if len(body) < n4*size4+n6*size6 {
+		return set, body, errStateTruncated
+	}
+
+	set.v4 = make([]vrp4, n4)
+	for i := range set.v4 {
+		v := &set.v4[i]
+		copy(v.addr[:], body)
+		v.bits, v.max = body[4], body[5]
+		v.asn = binary.BigEndian.Uint32(body[6:])
+		if version > 1 {
+			v.expires = binary.BigEndian.Uint32(body[10:])
+		}
+		if version > 2 {
+			v.tas = remap(binary.BigEndian.Uint32(body[14:]))
+		}
+		body = body[size4:]
+		if v.max == 0 || v.max < v.bits || v.max > 32 {
+			return set, body, fmt.Errorf("invalid VRP in state file: %v", v.roa())
+		}
+	}
+	set.v6 = make([]vrp6, n6)
+	for i := range set.v6 {
+		v := &set.v6[i]
+		copy(v.addr[:], body)
+		v.bits, v.max = body[16], body[17]
+		v.asn = binary.BigEndian.Uint32(body[18:])
+		if version > 1 {
+			v.expires = binary.BigEndian.Uint32(body[22:])
+		}
+		if version > 2 {
+			v.tas = remap(binary.BigEndian.Uint32(body[26:]))
+		}
+		body = body[size6:]
+		if v.max == 0 || v.max < v.bits || v.max > 128 {
+			return set, body, fmt.Errorf("invalid VRP in state file: %v", v.roa())
+		}
+	}
+
+	// The file could have been written by something else, so don't trust
+	// the order.
+	set.normalize()
+	return set, body, nil
+}
+
+// saveState writes the snapshot out if a state file is configured, along
+// with the validated set it came from. It's called with publishMutex held.
+func (s *CacheServer) saveState(snap *snapshot) {
+	if s.state == nil {
+		return
+	}
+	validated := snap.vrps
+	if s.haveValidated {
+		validated = s.validated
+	}
+	start := time.Now()
+	err := s.state.save(savedState{
+		session:   snap.session,
+		serial:    snap.serial,
+		created:   start,
+		sources:   sourceURLs(s.sources),
+		vrps:      snap.vrps,
+		validated: validated,
+	})
+	if err != nil {
+		log.Printf("unable to save state file: %v\n", err)
+		return
+	}
+	log.Printf("Saved %d VRPs for serial %d to state file in %v\n", snap.vrps.len(), snap.serial, time.Since(start))
+}
+
+// loadState publishes the saved state as the first snapshot, keeping the
+// session and serial so that clients can carry on with serial queries. A
+// state file older than maxAge is only used if there are no sources.
+//
+// The saved VRPs are what clients on the saved serial have, so they're the
+// first snapshot. The saved validated set then goes through the current
+// filters and SLURM like any other update, so changes to them while the
+// server was down are applied once and not on top of the old ones. Expired
+// VRPs are dropped and the thresholds checked, and a new serial is only used
+// if that changes anything. Sources are always fetched in full after a
+// restart, as nothing of theirs is saved but their URLs.
+func (s *CacheServer) loadState(maxAge time.Duration) bool {
+	if s.state == nil {
+		return false
+	}
+	start := time.Now()
+	st, err := s.state.load()
+	if err != nil {
+		log.Printf("unable to load state file: %v\n", err)
+		return false
+	}
+	if age := start.Sub(st.created); maxAge > 0 && age > maxAge {
+		if len(s.sources) > 0 {
+			log.Printf("not loading state file created %v ago, older than state_max_age of %v\n", age.Round(time.Second), maxAge)
+			return false
+		}
+		log.Printf("ALERT: state file was created %v ago, older than state_max_age of %v\n", age.Round(time.Second), maxAge)
+	}
+	s.session = st.session
+	base := newSnapshot(st.vrps, st.serial, st.session, serialDiff{})
+	s.current.Store(base)
+	s.updates.lastCheck = st.created
+	log.Printf("Loaded %d VRPs for serial %d from state file created %v in %v\n",
+		st.vrps.len(), st.serial, st.created, time.Since(start))
+
+	s.validated, s.haveValidated = st.validated, true
+	roas, removed := s.process(st.validated)
+	roas, _ = roas.unexpired(expiryCutoff(start))
+	if !makeDiff(roas, st.vrps, st.serial).diff {
+		base.aggregated = removed
+		return true
+	}
+	if _, err := s.publish(roas, removed, false); err != nil {
+		log.Printf("ALERT: %v\n", err)
+	}
+	return true
+}
+
+// reloadState returns the validated VRPs in the state file if it has changed
+// since it was last loaded. This is used when the file is the only source of
+// VRPs, and the local filters and SLURM are applied to them as usual.
+func (s *CacheServer) reloadState() (vrpSet, bool, error) {
+	if s.state == nil {
+		return vrpSet{}, false, nil
+	}
+	mtime, err := s.state.modified()
+	if err != nil {
+		return vrpSet{}, false, err
+	}
+	if mtime.Equal(s.state.loaded) {
+		return vrpSet{}, false, nil
+	}
+	st, err := s.state.load()
+	if err != nil {
+		return vrpSet{}, false, err
+	}
+	log.Printf("State file changed, loaded %d VRPs created %v\n", st.validated.len(), st.created)
+	return st.validated, true, nil
+}
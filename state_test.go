@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	want := savedState{
+		session: 42,
+		serial:  1234,
+		created: time.Unix(1700000000, 0),
+		sources: []string{"https://example.com/vrps.json", "https://example.net/vrps.json"},
+		vrps:    newVRPSet(makeROAs(1000, 0)),
+		// Only half of what was validated gets published.
+		validated: newVRPSet(makeROAs(2000, 0)),
+	}
+	want.vrps.v4[0].expires = 1700003600
+	want.vrps.v6[0].expires = 1700007200
+	want.vrps.v4[1].tas = trustAnchors.mask([]string{"ripe", "arin"})
+	var buf bytes.Buffer
+	if err := encodeState(&buf, want); err != nil {
+		t.Fatalf("Error encoding state: %v", err)
+	}
+	got, err := decodeState(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error decoding state: %v", err)
+	}
+	if got.session != want.session || got.serial != want.serial || !got.created.Equal(want.created) {
+		t.Errorf("Got session %d serial %d created %v, Want session %d serial %d created %v",
+			got.session, got.serial, got.created, want.session, want.serial, want.created)
+	}
+	if !slices.Equal(got.sources, want.sources) {
+		t.Errorf("Got sources %v, Want %v", got.sources, want.sources)
+	}
+	if !slices.Equal(got.vrps.v4, want.vrps.v4) || !slices.Equal(got.vrps.v6, want.vrps.v6) {
+		t.Errorf("VRPs differ after round trip")
+	}
+	if !slices.Equal(got.validated.v4, want.validated.v4) || !slices.Equal(got.validated.v6, want.validated.v6) {
+		t.Errorf("Validated VRPs differ after round trip")
+	}
+}
+
+func TestDecodeStateVersion3(t *testing.T) {
+	want := newVRPSet(makeROAs(10, 0))
+	var buf bytes.Buffer
+	if err := encodeState(&buf, savedState{vrps: want}); err != nil {
+		t.Fatalf("Error encoding state: %v", err)
+	}
+	// Version 3 is the same without the validated set, here two zero counts.
+	b := buf.Bytes()
+	b = bytes.Clone(b[:len(b)-12])
+	binary.BigEndian.PutUint16(b[8:], 3)
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+
+	got, err := decodeState(b)
+	if err != nil {
+		t.Fatalf("Error decoding version 3 state: %v", err)
+	}
+	if !slices.Equal(got.validated.v4, want.v4) || !slices.Equal(got.validated.v6, want.v6) {
+		t.Errorf("Version 3 validated VRPs should be the published ones")
+	}
+}
+
+func TestDecodeStateErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := encodeState(&buf, savedState{vrps: newVRPSet(makeROAs(10, 0))}); err != nil {
+		t.Fatalf("Error encoding state: %v", err)
+	}
+	good := buf.Bytes()
+
+	flipped := bytes.Clone(good)
+	flipped[30] ^= 0xff
+
+	tests := []struct {
+		desc  string
+		input []byte
+	}{
+		{
+			desc:  "empty",
+			input: nil,
+		},
+		{
+			desc:  "truncated",
+			input: good[:len(good)-10],
+		},
+		{
+			desc:  "corrupted",
+			input: flipped,
+		},
+		{
+			desc:  "not a state file",
+			input: []byte(`{"roas": []}`),
+		},
+	}
+	for _, v := range tests {
+		if _, err := decodeState(v.input); err == nil {
+			t.Errorf("Error on %s. Wanted an error, but none received", v.desc)
+		}
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	f, err := openStateFile(filepath.Join(t.TempDir(), "rpkirtr.state"))
+	if err != nil {
+		t.Fatalf("Error opening state file: %v", err)
+	}
+	if _, err := f.load(); err == nil {
+		t.Errorf("Loading a missing state file should fail")
+	}
+
+	for serial := range uint32(2) {
+		want := savedState{serial: serial, vrps: newVRPSet(makeROAs(100, int(serial)))}
+		if err := f.save(want); err != nil {
+			t.Fatalf("Error saving state file: %v", err)
+		}
+		got, err := f.load()
+		if err != nil {
+			t.Fatalf("Error loading state file: %v", err)
+		}
+		if got.serial != serial || !slices.Equal(got.vrps.v4, want.vrps.v4) {
+			t.Errorf("Loaded state does not match what was saved for serial %d", serial)
+		}
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	now := time.Now()
+	keep := roa{Prefix: netip.MustParsePrefix("193.0.0.0/21"), MaxMask: 21, ASN: 3333}
+	gone := roa{Prefix: netip.MustParsePrefix("193.0.8.0/24"), MaxMask: 24, ASN: 3333, Expires: now.Unix() - 60}
+	bogon := roa{Prefix: netip.MustParsePrefix("10.0.0.0/8"), MaxMask: 8, ASN: 3333}
+	other := roa{Prefix: netip.MustParsePrefix("192.0.0.0/16"), MaxMask: 16, ASN: 3333}
+	filters, err := parseFilters([]string{"bogons"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc       string
+		created    time.Time
+		vrps       []roa
+		validated  []roa
+		sources    []string
+		wantLoaded bool
+		wantSerial uint32
+		wantVRPs   int
+	}{
+		{
+			desc:       "unchanged",
+			created:    now,
+			vrps:       []roa{keep},
+			wantLoaded: true,
+			wantSerial: 10,
+			wantVRPs:   1,
+		},
+		{
+			desc:       "expired and filtered VRPs are withdrawn",
+			created:    now,
+			vrps:       []roa{keep, gone, bogon},
+			wantLoaded: true,
+			wantSerial: 11,
+			wantVRPs:   1,
+		},
+		{
+			desc:       "validated set is filtered again",
+			created:    now,
+			vrps:       []roa{keep},
+			validated:  []roa{keep, bogon, other},
+			wantLoaded: true,
+			wantSerial: 11,
+			wantVRPs:   2,
+		},
+		{
+			desc:    "too old with sources to use instead",
+			created: now.Add(-48 * time.Hour),
+			vrps:    []roa{keep},
+			sources: []string{"https://example.com/vrps.json"},
+		},
+		{
+			desc:       "too old without sources",
+			created:    now.Add(-48 * time.Hour),
+			vrps:       []roa{keep},
+			wantLoaded: true,
+			wantSerial: 10,
+			wantVRPs:   1,
+		},
+	}
+	for _, tc := range tests {
+		f, err := openStateFile(filepath.Join(t.TempDir(), "rpkirtr.state"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		validated := tc.validated
+		if validated == nil {
+			validated = tc.vrps
+		}
+		st := savedState{session: 7, serial: 10, created: tc.created, vrps: newVRPSet(tc.vrps), validated: newVRPSet(validated)}
+		if err := f.save(st); err != nil {
+			t.Fatal(err)
+		}
+		s := &CacheServer{
+			mutex:   &sync.RWMutex{},
+			state:   f,
+			filters: filters,
+		}
+		for _, u := range tc.sources {
+			s.sources = append(s.sources, newSources([]sourceConfig{{url: u}})...)
+		}
+		if loaded := s.loadState(24 * time.Hour); loaded != tc.wantLoaded {
+			t.Errorf("%s: Got loaded %t, Want %t", tc.desc, loaded, tc.wantLoaded)
+			continue
+		}
+		if !tc.wantLoaded {
+			continue
+		}
+		snap := s.current.Load()
+		if snap.session != 7 || snap.serial != tc.wantSerial || snap.vrps.len() != tc.wantVRPs {
+			t.Errorf("%s: Got session %d serial %d with %d VRPs, Want session 7 serial %d with %d",
+				tc.desc, snap.session, snap.serial, snap.vrps.len(), tc.wantSerial, tc.wantVRPs)
+		}
+		// Nothing is known about how the saved serial was reached.
+		if snap.serial == 10 && snap.hasDiff() {
+			t.Errorf("%s: Loaded snapshot has a diff", tc.desc)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"math/bits"
+	"strings"
+	"sync"
+)
+
+// trustAnchors numbers every trust anchor seen, so that a VRP can carry the
+// trust anchors it was issued under as a bitmask. The RIRs always come first
+// so their bits never change.
+var trustAnchors = newTARegistry("afrinic", "apnic", "arin", "lacnic", "ripe")
+
+// taRegistry maps trust anchor names to bits. There's room for 32, which is
+// far more than exist.
+type taRegistry struct {
+	mutex sync.Mutex
+	names []string
+	bits  map[string]uint32
+}
+
+func newTARegistry(names ...string) *taRegistry {
+	r := &taRegistry{bits: make(map[string]uint32)}
+	for _, name := range names {
+		r.bit(name)
+	}
+	return r
+}
+
+// bit returns the bit for name, adding it if it's new. Unknown or empty names
+// are zero.
+func (r *taRegistry) bit(name string) uint32 {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if b, ok := r.bits[name]; ok {
+		return b
+	}
+	if len(r.names) == 32 {
+		log.Printf("too many trust anchors, ignoring %q\n", name)
+		r.bits[name] = 0
+		return 0
+	}
+	b := uint32(1) << len(r.names)
+	r.names = append(r.names, name)
+	r.bits[name] = b
+	return b
+}
+
+// mask returns the bits for all of names.
+func (r *taRegistry) mask(names []string) uint32 {
+	var m uint32
+	for _, name := range names {
+		m |= r.bit(name)
+	}
+	return m
+}
+
+// lookup returns the names of the trust anchors in mask.
+func (r *taRegistry) lookup(mask uint32) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var names []string
+	for mask != 0 {
+		i := bits.TrailingZeros32(mask)
+		mask &^= 1 << i
+		if i < len(r.names) {
+			names = append(names, r.names[i])
+		}
+	}
+	return names
+}
+
+// all returns every name, in bit order.
+func (r *taRegistry) all() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.names...)
+}
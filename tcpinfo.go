@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// tcpSampleInterval is how often each client connection has TCP_INFO read.
+const tcpSampleInterval = 15 * time.Second
+
+// errNoTCPInfo is returned on platforms without TCP_INFO.
+var errNoTCPInfo = errors.New("tcp info is only supported on linux")
+
+// tcpStats is the health of a client's TCP connection at the time it was sampled.
+type tcpStats struct {
+	sampled     time.Time
+	rtt         time.Duration
+	rttVar      time.Duration
+	retransmits uint32
+	sendQueue   uint32
+	cwnd        uint32
+	mss         uint32
+}
+
+// sampleTCP will periodically record TCP_INFO for the client until it's closed.
+func (c *client) sampleTCP() {
+	ticker := time.NewTicker(tcpSampleInterval)
+	defer ticker.Stop()
+	for {
+		stats, err := readTCPStats(c.conn)
+		if errors.Is(err, errNoTCPInfo) {
+			return
+		}
+		if err != nil {
+			log.Printf("unable to sample tcp info for %s, stopping: %v\n", c.addr, err)
+			return
+		}
+		c.tcpMutex.Lock()
+		c.tcp = stats
+		c.tcpMutex.Unlock()
+
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tcpStats returns the last sample of TCP_INFO for the client.
+func (c *client) tcpStats() tcpStats {
+	c.tcpMutex.Lock()
+	defer c.tcpMutex.Unlock()
+	return c.tcp
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// readTCPStats uses TCP_INFO and SIOCOUTQ on the socket under conn.
+func readTCPStats(conn net.Conn) (tcpStats, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return tcpStats{}, fmt.Errorf("connection type %T has no socket", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return tcpStats{}, err
+	}
+
+	var info syscall.TCPInfo
+	var outq int32
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			serr = fmt.Errorf("getsockopt TCP_INFO: %w", errno)
+			return
+		}
+		// SIOCOUTQ shares its value with TIOCOUTQ.
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&outq)))
+		if errno != 0 {
+			serr = fmt.Errorf("ioctl SIOCOUTQ: %w", errno)
+		}
+	})
+	if err != nil {
+		return tcpStats{}, err
+	}
+	if serr != nil {
+		return tcpStats{}, serr
+	}
+
+	return tcpStats{
+		sampled:     time.Now(),
+		rtt:         time.Duration(info.Rtt) * time.Microsecond,
+		rttVar:      time.Duration(info.Rttvar) * time.Microsecond,
+		retransmits: info.Total_retrans,
+		sendQueue:   uint32(outq),
+		cwnd:        info.Snd_cwnd,
+		mss:         info.Snd_mss,
+	}, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReadTCPStats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readTCPStats(conn)
+	if err != nil {
+		t.Fatalf("Error reading tcp stats: %v", err)
+	}
+	if got.sampled.IsZero() {
+		t.Errorf("Sample time not set")
+	}
+	if got.cwnd == 0 {
+		t.Errorf("Congestion window should not be zero on an established connection")
+	}
+
+	// Anything that's not a socket can't be sampled.
+	pipe, _ := net.Pipe()
+	if _, err := readTCPStats(pipe); err == nil {
+		t.Errorf("Wanted an error reading tcp stats from a pipe, but none received")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// readTCPStats is only supported on Linux.
+func readTCPStats(conn net.Conn) (tcpStats, error) {
+	return tcpStats{}, errNoTCPInfo
+}
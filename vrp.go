@@ -0,0 +1,310 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"iter"
+	"math"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// vrp4 is a packed IPv4 VRP. It takes 20 bytes against the 56 of a roa.
+// expires is in unix seconds, zero if never, and tas is a bitmask of
+// trustAnchors.
+type vrp4 struct {
+	addr    [4]byte
+	bits    uint8
+	max     uint8
+	asn     uint32
+	expires uint32
+	tas     uint32
+}
+
+// vrp6 is a packed IPv6 VRP. It takes 32 bytes against the 56 of a roa.
+type vrp6 struct {
+	addr    [16]byte
+	bits    uint8
+	max     uint8
+	asn     uint32
+	expires uint32
+	tas     uint32
+}
+
+// vrpSet holds VRPs split by address family. Once normalized, each family is
+// sorted with no duplicates, which lets sets be diffed with a single merge.
+// Expiry and trust anchors aren't part of what makes a VRP unique, so
+// duplicates are merged, keeping whichever expires last and every trust
+// anchor.
+type vrpSet struct {
+	v4 []vrp4
+	v6 []vrp6
+}
+
+// newVRPSet returns a normalized set of the valid ROAs.
+func newVRPSet(roas []roa) vrpSet {
+	var s vrpSet
+	for _, r := range roas {
+		s.add(r)
+	}
+	return GetSetOfValidatedROAs(s)
+}
+
+// add will append the ROA if valid. The set needs to be normalized afterwards.
+func (s *vrpSet) add(r roa) {
+	if !r.isValid() {
+		return
+	}
+	// Anything past 2106 may as well never expire.
+	expires := uint32(min(max(r.Expires, 0), math.MaxUint32))
+	if r.Prefix.Addr().Is4() {
+		s.v4 = append(s.v4, vrp4{
+			addr:    r.Prefix.Addr().As4(),
+			bits:    uint8(r.Prefix.Bits()),
+			max:     r.MaxMask,
+			asn:     r.ASN,
+			expires: expires,
+			tas:     r.TAs,
+		})
+		return
+	}
+	s.v6 = append(s.v6, vrp6{
+		addr:    r.Prefix.Addr().As16(),
+		bits:    uint8(r.Prefix.Bits()),
+		max:     r.MaxMask,
+		asn:     r.ASN,
+		expires: expires,
+		tas:     r.TAs,
+	})
+}
+
+// merge appends all of o on to s. The set needs to be normalized afterwards.
+func (s *vrpSet) merge(o vrpSet) {
+	s.v4 = append(s.v4, o.v4...)
+	s.v6 = append(s.v6, o.v6...)
+}
+
+// normalize sorts and removes duplicates in place.
+func (s *vrpSet) normalize() {
+	s.sort()
+	s.v4 = keepRuns(s.v4, 1, compareVRP4)
+	s.v6 = keepRuns(s.v6, 1, compareVRP6)
+}
+
+// sort orders the set with the latest expiry first among duplicates.
+func (s *vrpSet) sort() {
+	slices.SortFunc(s.v4, func(a, b vrp4) int {
+		return cmp.Or(compareVRP4(a, b), compareExpiry(b.expires, a.expires))
+	})
+	slices.SortFunc(s.v6, func(a, b vrp6) int {
+		return cmp.Or(compareVRP6(a, b), compareExpiry(b.expires, a.expires))
+	})
+}
+
+// expiryWindow batches expiries, so a feed with VRPs expiring seconds apart
+// doesn't cause a new serial for each. VRPs are withdrawn at the start of the
+// window they expire in.
+const expiryWindow = time.Minute
+
+// expiryCutoff returns when VRPs withdrawn at now expire by, which is the end
+// of the current window.
+func expiryCutoff(now time.Time) time.Time {
+	return now.Truncate(expiryWindow).Add(expiryWindow)
+}
+
+// expiryDue returns when a VRP which expires at t is withdrawn.
+func expiryDue(t time.Time) time.Time {
+	return t.Add(-time.Nanosecond).Truncate(expiryWindow)
+}
+
+// unexpired returns the set without any VRPs expired at now, and how many
+// were removed. s is only copied if something has expired.
+func (s vrpSet) unexpired(now time.Time) (vrpSet, int) {
+	cutoff := now.Unix()
+	gone4 := func(v vrp4) bool { return v.expires != 0 && int64(v.expires) <= cutoff }
+	gone6 := func(v vrp6) bool { return v.expires != 0 && int64(v.expires) <= cutoff }
+	if !slices.ContainsFunc(s.v4, gone4) && !slices.ContainsFunc(s.v6, gone6) {
+		return s, 0
+	}
+	out := vrpSet{
+		v4: slices.DeleteFunc(slices.Clone(s.v4), gone4),
+		v6: slices.DeleteFunc(slices.Clone(s.v6), gone6),
+	}
+	return out, s.len() - out.len()
+}
+
+// nextExpiry returns when the first VRP in the set expires, or zero if none
+// do.
+func (s vrpSet) nextExpiry() time.Time {
+	var next uint32
+	for _, v := range s.v4 {
+		if v.expires != 0 && (next == 0 || v.expires < next) {
+			next = v.expires
+		}
+	}
+	for _, v := range s.v6 {
+		if v.expires != 0 && (next == 0 || v.expires < next) {
+			next = v.expires
+		}
+	}
+	if next == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(next), 0)
+}
+
+func (s vrpSet) len() int {
+	return len(s.v4) + len(s.v6)
+}
+
+// all yields every VRP as a roa, IPv4 first.
+func (s vrpSet) all() iter.Seq[roa] {
+	return func(yield func(roa) bool) {
+		for _, v := range s.v4 {
+			if !yield(v.roa()) {
+				return
+			}
+		}
+		for _, v := range s.v6 {
+			if !yield(v.roa()) {
+				return
+			}
+		}
+	}
+}
+
+// roas returns every VRP as a roa, IPv4 first.
+func (s vrpSet) roas() []roa {
+	roas := make([]roa, 0, s.len())
+	for r := range s.all() {
+		roas = append(roas, r)
+	}
+	return roas
+}
+
+func (v vrp4) roa() roa {
+	return roa{
+		Prefix:  netip.PrefixFrom(netip.AddrFrom4(v.addr), int(v.bits)),
+		MaxMask: v.max,
+		ASN:     v.asn,
+		Expires: int64(v.expires),
+		TAs:     v.tas,
+	}
+}
+
+func (v vrp6) roa() roa {
+	return roa{
+		Prefix:  netip.PrefixFrom(netip.AddrFrom16(v.addr), int(v.bits)),
+		MaxMask: v.max,
+		ASN:     v.asn,
+		Expires: int64(v.expires),
+		TAs:     v.tas,
+	}
+}
+
+// merged returns v with the later expiry and the trust anchors of both.
+func (v vrp4) merged(o vrp4) vrp4 {
+	if compareExpiry(o.expires, v.expires) > 0 {
+		v.expires = o.expires
+	}
+	v.tas |= o.tas
+	return v
+}
+
+func (v vrp6) merged(o vrp6) vrp6 {
+	if compareExpiry(o.expires, v.expires) > 0 {
+		v.expires = o.expires
+	}
+	v.tas |= o.tas
+	return v
+}
+
+func (v vrp4) pdu(flag uint8) ipv4PrefixPDU {
+	return ipv4PrefixPDU{
+		flags:  flag,
+		min:    v.bits,
+		max:    v.max,
+		prefix: v.addr,
+		asn:    v.asn,
+	}
+}
+
+func (v vrp6) pdu(flag uint8) ipv6PrefixPDU {
+	return ipv6PrefixPDU{
+		flags:  flag,
+		min:    v.bits,
+		max:    v.max,
+		prefix: v.addr,
+		asn:    v.asn,
+	}
+}
+
+// compareVRP4 orders by address, then prefix length, max length and ASN.
+func compareVRP4(a, b vrp4) int {
+	if c := cmp.Compare(binary.BigEndian.Uint32(a.addr[:]), binary.BigEndian.Uint32(b.addr[:])); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.bits, b.bits); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.max, b.max); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.asn, b.asn)
+}
+
+// compareVRP6 orders by address, then prefix length, max length and ASN.
+func compareVRP6(a, b vrp6) int {
+	if c := cmp.Compare(binary.BigEndian.Uint64(a.addr[:8]), binary.BigEndian.Uint64(b.addr[:8])); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(binary.BigEndian.Uint64(a.addr[8:]), binary.BigEndian.Uint64(b.addr[8:])); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.bits, b.bits); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.max, b.max); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.asn, b.asn)
+}
+
+// compareExpiry orders expiry times, where zero is never and so the latest.
+func compareExpiry(a, b uint32) int {
+	switch {
+	case a == b:
+		return 0
+	case a == 0:
+		return 1
+	case b == 0:
+		return -1
+	}
+	return cmp.Compare(a, b)
+}
+
+// diffSorted walks two sorted slices together, calling add for anything only
+// in new and del for anything only in old.
+func diffSorted[T any](new, old []T, compare func(a, b T) int, add, del func(T)) {
+	var i, j int
+	for i < len(new) && j < len(old) {
+		switch c := compare(new[i], old[j]); {
+		case c < 0:
+			add(new[i])
+			i++
+		case c > 0:
+			del(old[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	for ; i < len(new); i++ {
+		add(new[i])
+	}
+	for ; j < len(old); j++ {
+		del(old[j])
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestVRPSetNormalize(t *testing.T) {
+	roas := []roa{
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 1},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 2},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 2},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 16, ASN: 2},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 2},
+		{Prefix: netip.MustParsePrefix("10.0.2.0/24"), MaxMask: 23, ASN: 2},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 1},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 129, ASN: 1},
+	}
+	want := []roa{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 16, ASN: 2},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 24, ASN: 2},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), MaxMask: 24, ASN: 2},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 1},
+	}
+	if got := newVRPSet(roas).roas(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, Want %v", got, want)
+	}
+}
+
+func TestVRPSetDiff(t *testing.T) {
+	old := newVRPSet([]roa{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 16, ASN: 1},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), MaxMask: 16, ASN: 1},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 1},
+	})
+	new := newVRPSet([]roa{
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), MaxMask: 16, ASN: 1},
+		{Prefix: netip.MustParsePrefix("10.2.0.0/16"), MaxMask: 16, ASN: 1},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 2},
+	})
+	got := makeDiff(new, old, 1)
+	wantAdd := []roa{
+		{Prefix: netip.MustParsePrefix("10.2.0.0/16"), MaxMask: 16, ASN: 1},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 2},
+	}
+	wantDel := []roa{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/16"), MaxMask: 16, ASN: 1},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxMask: 48, ASN: 1},
+	}
+	if !reflect.DeepEqual(got.addRoa, wantAdd) {
+		t.Errorf("Got add %v, Want %v", got.addRoa, wantAdd)
+	}
+	if !reflect.DeepEqual(got.delRoa, wantDel) {
+		t.Errorf("Got del %v, Want %v", got.delRoa, wantDel)
+	}
+}
+
+func TestVRPSetExpiry(t *testing.T) {
+	p := netip.MustParsePrefix("10.0.0.0/16")
+	q := netip.MustParsePrefix("2001:db8::/32")
+	set := newVRPSet([]roa{
+		{Prefix: p, MaxMask: 16, ASN: 1, Expires: 100},
+		{Prefix: p, MaxMask: 16, ASN: 1, Expires: 300},
+		{Prefix: p, MaxMask: 24, ASN: 1, Expires: 200},
+		{Prefix: p, MaxMask: 24, ASN: 1},
+		{Prefix: q, MaxMask: 48, ASN: 1, Expires: 150},
+	})
+	// Duplicates keep the latest expiry, and no expiry is the latest.
+	want := []roa{
+		{Prefix: p, MaxMask: 16, ASN: 1, Expires: 300},
+		{Prefix: p, MaxMask: 24, ASN: 1},
+		{Prefix: q, MaxMask: 48, ASN: 1, Expires: 150},
+	}
+	if got := set.roas(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, Want %v", got, want)
+	}
+	if got := set.nextExpiry(); !got.Equal(time.Unix(150, 0)) {
+		t.Errorf("Got next expiry %v, Want 150", got.Unix())
+	}
+
+	before := set.roas()
+	left, n := set.unexpired(time.Unix(150, 0))
+	if n != 1 || !reflect.DeepEqual(left.roas(), want[:2]) {
+		t.Errorf("Got %d expired leaving %v, Want 1 leaving %v", n, left.roas(), want[:2])
+	}
+	if !reflect.DeepEqual(set.roas(), before) {
+		t.Errorf("unexpired changed the original set")
+	}
+	if _, n := set.unexpired(time.Unix(149, 0)); n != 0 {
+		t.Errorf("Got %d expired before any expiry", n)
+	}
+	if got := newVRPSet(want[1:2]).nextExpiry(); !got.IsZero() {
+		t.Errorf("Got next expiry %v for a set that never expires", got)
+	}
+
+	// 150 is withdrawn from the start of its window, 120 to 180.
+	if got := expiryDue(time.Unix(150, 0)); !got.Equal(time.Unix(120, 0)) {
+		t.Errorf("Got 150 due at %v, Want 120", got.Unix())
+	}
+	if got := expiryDue(time.Unix(180, 0)); !got.Equal(time.Unix(120, 0)) {
+		t.Errorf("Got 180 due at %v, Want 120", got.Unix())
+	}
+	if got := expiryCutoff(time.Unix(120, 0)); !got.Equal(time.Unix(180, 0)) {
+		t.Errorf("Got cutoff %v at 120, Want 180", got.Unix())
+	}
+}
+
+// BenchmarkVRPSetMemory compares the old unique set, a slice of roa
+// deduplicated through a map, against the packed set. retained-B/op is the
+// size of the resulting set, B/op is everything allocated on the way.
+func BenchmarkVRPSetMemory(b *testing.B) {
+	roas := makeROAs(500000, 0)
+	// Sources overlap, so every ROA is seen twice.
+	roas = append(roas, roas...)
+
+	b.Run("roa-map", func(b *testing.B) {
+		b.ReportAllocs()
+		var retained int
+		for b.Loop() {
+			u := make([]roa, 0, len(roas))
+			m := make(map[roa]bool)
+			for _, roa := range roas {
+				if _, ok := m[roa]; !ok {
+					m[roa] = true
+					if roa.isValid() {
+						u = append(u, roa)
+					}
+				}
+			}
+			retained = cap(u) * int(unsafe.Sizeof(roa{}))
+		}
+		b.ReportMetric(float64(retained), "retained-B/op")
+	})
+	b.Run("packed", func(b *testing.B) {
+		b.ReportAllocs()
+		var retained int
+		for b.Loop() {
+			var s vrpSet
+			for _, r := range roas {
+				s.add(r)
+			}
+			s = GetSetOfValidatedROAs(s)
+			retained = cap(s.v4)*int(unsafe.Sizeof(vrp4{})) + cap(s.v6)*int(unsafe.Sizeof(vrp6{}))
+		}
+		b.ReportMetric(float64(retained), "retained-B/op")
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"syscall"
+	"unsafe"
+)
+
+// watchDir sends the name of each file in dir that's finished being written,
+// moved in, or removed. Files still being written aren't sent until closed.
+func watchDir(dir string) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	ch := make(chan string, 16)
+	go func() {
+		defer close(ch)
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				log.Printf("stopped watching %s: %v\n", dir, err)
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+				off += syscall.SizeofInotifyEvent + int(ev.Len)
+				if ev.Mask&syscall.IN_IGNORED != 0 {
+					log.Printf("stopped watching %s, it was removed\n", dir)
+					return
+				}
+				// Names are padded with NULs.
+				if i := bytes.IndexByte(name, 0); i >= 0 {
+					name = name[:i]
+				}
+				if len(name) > 0 {
+					ch <- string(name)
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchSources(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "vrps.json")
+	writeFile(t, name, vrpJSON("192.0.2.0/24"))
+
+	s := &CacheServer{
+		sources:    newSources([]sourceConfig{{url: "file://" + name}}),
+		refreshNow: make(chan struct{}, 1),
+	}
+	s.watchSources()
+
+	// Other files in the same directory don't cause a refresh.
+	writeFile(t, filepath.Join(dir, "other.json"), vrpJSON("198.51.100.0/24"))
+	select {
+	case <-s.refreshNow:
+		t.Fatalf("Refresh triggered by another file")
+	case <-time.After(fileSettle + 500*time.Millisecond):
+	}
+
+	writeFile(t, name, vrpJSON("198.51.100.0/24"))
+	select {
+	case <-s.refreshNow:
+	case <-time.After(fileSettle + 2*time.Second):
+		t.Errorf("No refresh after the file was replaced")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// watchDir is only supported on Linux. Files are still read on every refresh.
+func watchDir(dir string) (<-chan string, error) {
+	return nil, errWatchUnsupported
+}